@@ -0,0 +1,112 @@
+// Package cache provides a size bounded cache of expiring values, and an
+// OpenTSDB context that shares query responses through it.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/collect"
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+)
+
+// Cache holds values until they expire or, once the total size of its values
+// exceeds MaxSize, until they are the least recently used. It is safe for
+// concurrent use.
+type Cache struct {
+	// Name is the value of the cache tag of the metrics of the cache.
+	Name    string
+	MaxSize int64
+	lock    sync.Mutex
+	lru     *list.List // of *entry, most recently used first
+	entries map[string]*list.Element
+	size    int64
+}
+
+type entry struct {
+	key     string
+	value   interface{}
+	err     error
+	size    int64
+	expires time.Time
+	ready   chan bool
+}
+
+func New(name string, maxSize int64) *Cache {
+	return &Cache{
+		Name:    name,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// Get returns the value of key. If key is missing or has expired, fetch is
+// called to get the value and its size, which is then kept for ttl. Concurrent
+// calls for the same key share a single fetch. Errors are not cached.
+func (c *Cache) Get(key string, ttl time.Duration, fetch func() (interface{}, int64, error)) (interface{}, error) {
+	tags := opentsdb.TagSet{"cache": c.Name}
+	c.lock.Lock()
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		select {
+		case <-e.ready:
+			if time.Now().Before(e.expires) {
+				c.lru.MoveToFront(el)
+				c.lock.Unlock()
+				collect.Add("query_cache.hits", tags, 1)
+				return e.value, nil
+			}
+			c.remove(el)
+		default:
+			c.lock.Unlock()
+			<-e.ready
+			collect.Add("query_cache.hits", tags, 1)
+			return e.value, e.err
+		}
+	}
+	e := &entry{key: key, ready: make(chan bool)}
+	el := c.lru.PushFront(e)
+	c.entries[key] = el
+	c.lock.Unlock()
+	collect.Add("query_cache.misses", tags, 1)
+
+	v, size, err := fetch()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.value, e.err, e.expires = v, err, time.Now().Add(ttl)
+	close(e.ready)
+	if c.entries[key] != el {
+		// Evicted while fetching.
+		return v, err
+	}
+	if err != nil || size > c.MaxSize {
+		c.remove(el)
+		return v, err
+	}
+	e.size = size
+	c.size += size
+	for c.size > c.MaxSize {
+		c.remove(c.lru.Back())
+		collect.Add("query_cache.evictions", tags, 1)
+	}
+	collect.Put("query_cache.bytes", tags, c.size)
+	return v, err
+}
+
+// remove deletes el from c. c must be locked.
+func (c *Cache) remove(el *list.Element) {
+	e := el.Value.(*entry)
+	c.lru.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// Size returns the total size of the values in c.
+func (c *Cache) Size() int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.size
+}
@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+)
+
+func TestCache(t *testing.T) {
+	c := New("test", 10)
+	fetches := 0
+	get := func(key string, size int64, ttl time.Duration) interface{} {
+		v, err := c.Get(key, ttl, func() (interface{}, int64, error) {
+			fetches++
+			return key, size, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	if v := get("a", 4, time.Hour); v != "a" || fetches != 1 {
+		t.Fatalf("unexpected value %v after %v fetches", v, fetches)
+	}
+	get("a", 4, time.Hour)
+	if fetches != 1 {
+		t.Errorf("expected cached value, got %v fetches", fetches)
+	}
+	get("b", 4, time.Hour)
+	// a is more recently used than b, so b is evicted.
+	get("a", 4, time.Hour)
+	get("c", 4, time.Hour)
+	if fetches != 3 || c.Size() != 8 {
+		t.Fatalf("unexpected %v fetches with size %v", fetches, c.Size())
+	}
+	get("a", 4, time.Hour)
+	get("b", 4, time.Hour)
+	if fetches != 4 {
+		t.Errorf("expected b to be evicted, got %v fetches", fetches)
+	}
+	get("d", 20, time.Hour)
+	get("d", 20, time.Hour)
+	if fetches != 6 || c.Size() != 8 {
+		t.Errorf("expected oversized value to not be cached, got %v fetches with size %v", fetches, c.Size())
+	}
+	get("e", 1, 0)
+	get("e", 1, 0)
+	if fetches != 8 {
+		t.Errorf("expected expired value to be fetched, got %v fetches", fetches)
+	}
+}
+
+func TestCacheErrors(t *testing.T) {
+	c := New("test", 10)
+	fetches := 0
+	for i := 0; i < 2; i++ {
+		_, err := c.Get("a", time.Hour, func() (interface{}, int64, error) {
+			fetches++
+			return nil, 0, fmt.Errorf("failed")
+		})
+		if err == nil {
+			t.Error("expected error")
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("expected errors to not be cached, got %v fetches", fetches)
+	}
+}
+
+func TestCacheConcurrent(t *testing.T) {
+	c := New("test", 10)
+	var fetches int
+	var wg sync.WaitGroup
+	release := make(chan bool)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.Get("a", time.Hour, func() (interface{}, int64, error) {
+				fetches++
+				<-release
+				return 1, 1, nil
+			})
+			if err != nil || v != 1 {
+				t.Errorf("unexpected result %v, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if fetches != 1 {
+		t.Errorf("expected 1 fetch, got %v", fetches)
+	}
+}
+
+type countContext struct {
+	requests []*opentsdb.Request
+}
+
+func (c *countContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	c.requests = append(c.requests, r)
+	return opentsdb.ResponseSet{{Metric: "m", DPS: map[string]opentsdb.Point{"0": 1}}}, nil
+}
+
+func TestTSDB(t *testing.T) {
+	cc := new(countContext)
+	tsdb := &TSDB{
+		Cache:   New("test", 1<<20),
+		Context: cc,
+		TTL:     time.Minute,
+	}
+	q, err := opentsdb.ParseQuery("sum:m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(start, end string) {
+		rs, err := tsdb.Query(&opentsdb.Request{
+			Start:   start,
+			End:     end,
+			Queries: []*opentsdb.Query{q},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rs) != 1 {
+			t.Fatalf("unexpected response: %v", rs)
+		}
+	}
+	request("2015/01/01-10:00:10", "2015/01/01-11:00:10")
+	request("2015/01/01-10:00:50", "2015/01/01-11:00:50")
+	if len(cc.requests) != 1 {
+		t.Fatalf("expected 1 request, got %v", len(cc.requests))
+	}
+	if r := cc.requests[0]; r.Start != "2015/01/01-10:00:10" || r.End != "2015/01/01-11:00:10" {
+		t.Errorf("expected exact request, got %v to %v", r.Start, r.End)
+	}
+	request("2015/01/01-10:01:00", "2015/01/01-11:01:00")
+	if len(cc.requests) != 2 {
+		t.Errorf("expected 2 requests, got %v", len(cc.requests))
+	}
+	// A 5m range caches for at most 30s.
+	request("2015/01/01-10:00:10", "2015/01/01-10:05:10")
+	request("2015/01/01-10:00:20", "2015/01/01-10:05:20")
+	if len(cc.requests) != 3 {
+		t.Errorf("expected 3 requests, got %v", len(cc.requests))
+	}
+	request("2015/01/01-10:00:40", "2015/01/01-10:05:40")
+	if len(cc.requests) != 4 {
+		t.Errorf("expected 4 requests, got %v", len(cc.requests))
+	}
+}
+
+func TestMemo(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		fmt.Fprint(w, `[{"metric":"m","tags":{"host":"a"},"dps":{"0":1}}]`)
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewMemo(u.Host, 1<<20)
+	q, err := opentsdb.ParseQuery("sum:m{host=*}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rs, err := m.Query(&opentsdb.Request{Start: "1h-ago", Queries: []*opentsdb.Query{q}})
+			if err != nil || len(rs) != 1 {
+				t.Errorf("unexpected response %v, %v", rs, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if requests != 1 {
+		t.Errorf("expected 1 request, got %v", requests)
+	}
+}
@@ -0,0 +1,54 @@
+package cache
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+)
+
+// Memo is an OpenTSDB context that remembers the response to each distinct
+// request for its lifetime, like opentsdb.Cache, but is safe for concurrent
+// use. Concurrent identical requests are sent once.
+type Memo struct {
+	Host string
+	// Limit limits response size in bytes
+	Limit     int64
+	lock      sync.Mutex
+	responses map[string]*memoEntry
+}
+
+type memoEntry struct {
+	rs    opentsdb.ResponseSet
+	err   error
+	ready chan bool
+}
+
+func NewMemo(host string, limit int64) *Memo {
+	return &Memo{
+		Host:      host,
+		Limit:     limit,
+		responses: make(map[string]*memoEntry),
+	}
+}
+
+func (m *Memo) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	key := string(b)
+	m.lock.Lock()
+	if e, ok := m.responses[key]; ok {
+		m.lock.Unlock()
+		<-e.ready
+		return e.rs, e.err
+	}
+	e := &memoEntry{ready: make(chan bool)}
+	m.responses[key] = e
+	m.lock.Unlock()
+	// A Cache used for a single request is never shared, so it needs no lock.
+	e.rs, e.err = opentsdb.NewCache(m.Host, m.Limit).Query(r)
+	close(e.ready)
+	return e.rs, e.err
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+)
+
+// TSDB is an OpenTSDB context that answers requests from a Cache shared by
+// many contexts, falling back to Context. Requests whose start and end fall in
+// the same TTL bucket are answered by one response, which is fetched for the
+// exact range of the first of them. The bucket, and so the staleness of a
+// response, is capped at a tenth of the request's range.
+type TSDB struct {
+	*Cache
+	Context opentsdb.Context
+	TTL     time.Duration
+}
+
+// rangeFraction is the smallest number of buckets a request's range is split
+// into.
+const rangeFraction = 10
+
+func (t *TSDB) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	req, ttl, err := roundRequest(r, t.TTL)
+	if err != nil || ttl <= 0 {
+		return t.Context.Query(r)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	v, err := t.Get(string(b), ttl, func() (interface{}, int64, error) {
+		rs, err := t.Context.Query(r)
+		return rs, responseSize(rs), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(opentsdb.ResponseSet), nil
+}
+
+// roundRequest returns a copy of r whose absolute start and end times are
+// rounded down to a multiple of the bucket size, and the bucket size: d, or a
+// tenth of the range of r if that is shorter.
+func roundRequest(r *opentsdb.Request, d time.Duration) (*opentsdb.Request, time.Duration, error) {
+	req := *r
+	start, err := opentsdb.ParseTime(r.Start)
+	if err != nil {
+		return nil, 0, err
+	}
+	end := time.Now().UTC()
+	if r.End != nil {
+		if end, err = opentsdb.ParseTime(r.End); err != nil {
+			return nil, 0, err
+		}
+	}
+	if max := end.Sub(start) / rangeFraction; max < d {
+		d = max
+	}
+	if d <= 0 {
+		return nil, 0, nil
+	}
+	req.Start = start.Truncate(d).Format(opentsdb.TSDBTimeFormat)
+	if r.End != nil {
+		req.End = end.Truncate(d).Format(opentsdb.TSDBTimeFormat)
+	}
+	return &req, d, nil
+}
+
+// responseSize estimates the memory used by rs.
+func responseSize(rs opentsdb.ResponseSet) int64 {
+	const (
+		responseOverhead = 100
+		pointSize        = 40 // timestamp key, value and map overhead
+	)
+	var n int64
+	for _, r := range rs {
+		n += responseOverhead + int64(len(r.Metric))
+		for k, v := range r.Tags {
+			n += int64(len(k) + len(v))
+		}
+		n += int64(len(r.DPS)) * pointSize
+	}
+	return n
+}
@@ -25,34 +25,44 @@ import (
 
 type Conf struct {
 	Vars
-	Name            string        // Config file name
-	CheckFrequency  time.Duration // Time between alert checks: 5m
-	WebDir          string        // Static content web directory: web
-	TsdbHost        string        // OpenTSDB relay and query destination: ny-devtsdb04:4242
-	HttpListen      string        // Web server listen address: :80
-	RelayListen     string        // OpenTSDB relay listen address: :4242
-	SmtpHost        string        // SMTP address: ny-mail:25
-	Ping            bool
-	EmailFrom       string
-	StateFile       string
-	TimeAndDate     []int // timeanddate.com cities list
-	ResponseLimit   int64
-	UnknownTemplate *Template
-	Templates       map[string]*Template
-	Alerts          map[string]*Alert
-	Notifications   map[string]*Notification `json:"-"`
-	RawText         string
-	Macros          map[string]*Macro
-	Lookups         map[string]*Lookup
-	Squelch         Squelches `json:"-"`
-	Quiet           bool
+	Name             string        // Config file name
+	CheckFrequency   time.Duration // Time between alert checks: 5m
+	WebDir           string        // Static content web directory: web
+	TsdbHost         string        // OpenTSDB relay and query destination: ny-devtsdb04:4242
+	GraphiteHost     string        // Graphite render API query destination: ny-graphite01:80
+	HttpListen       string        // Web server listen address: :80
+	RelayListen      string        // OpenTSDB relay listen address: :4242
+	SmtpHost         string        // SMTP address: ny-mail:25
+	Ping             bool
+	EmailFrom        string
+	StateFile        string
+	TimeAndDate      []int // timeanddate.com cities list
+	ResponseLimit    int64
+	QueryConcurrency int           // Maximum concurrent queries per check run: 8
+	CheckConcurrency int           // Maximum alerts checked concurrently: 4
+	AlertTimeout     time.Duration // Maximum time to check one alert, defaults to CheckFrequency: 5m
+	QueryCacheSize   int64         // Bytes of query responses shared between check runs, 0 disables: 100000000
+	QueryCacheTTL    time.Duration // Lifetime of shared query responses: 1m
+	ReloadToken      string        `json:"-"` // Secret required by /api/reload, read from reloadTokenFile
+	UnknownTemplate  *Template
+	Templates        map[string]*Template
+	Alerts           map[string]*Alert
+	Notifications    map[string]*Notification `json:"-"`
+	RawText          string                   // Text of the configuration, with included files inlined
+	Macros           map[string]*Macro
+	Lookups          map[string]*Lookup
+	Squelch          Squelches `json:"-"`
+	Quiet            bool
 
 	tree            *parse.Tree
+	alertDefs       map[string]*alertDef
 	node            parse.Node
 	unknownTemplate string
 	bodies          *htemplate.Template
 	subjects        *ttemplate.Template
 	squelch         []string
+	// noFiles rejects settings that read local files.
+	noFiles bool
 }
 
 type Squelch map[string]*regexp.Regexp
@@ -196,6 +206,10 @@ type Alert struct {
 	CritNotification *Notifications
 	WarnNotification *Notifications
 	Unknown          time.Duration
+	RunEvery         time.Duration // Time between checks of this alert, defaults to CheckFrequency
+	MaxQueries       int           // Maximum queries per expression check, 0 for no limit
+	MaxDatapoints    int           // Maximum datapoints returned per expression check, 0 for no limit
+	MaxDuration      time.Duration // Maximum time per expression check, 0 for no limit
 	IgnoreUnknown    bool
 	Macros           []string `json:"-"`
 	UnjoinedOK       bool     `json:",omitempty"`
@@ -292,28 +306,49 @@ func ParseFile(fname string) (*Conf, error) {
 }
 
 func New(name, text string) (c *Conf, err error) {
+	return newConf(name, text, false)
+}
+
+// NewNoInclude is like New, but rejects include directives and settings that
+// read local files, such as reloadTokenFile. It is for configuration text
+// submitted over the web, which must not read local files.
+func NewNoInclude(name, text string) (c *Conf, err error) {
+	return newConf(name, text, true)
+}
+
+func newConf(name, text string, noFiles bool) (c *Conf, err error) {
 	defer errRecover(&err)
 	c = &Conf{
-		Name:           name,
-		CheckFrequency: time.Minute * 5,
-		HttpListen:     ":8070",
-		WebDir:         "web",
-		StateFile:      "bosun.state",
-		ResponseLimit:  1 << 20, // 1MB
-		Vars:           make(map[string]string),
-		Templates:      make(map[string]*Template),
-		Alerts:         make(map[string]*Alert),
-		Notifications:  make(map[string]*Notification),
-		RawText:        text,
-		bodies:         htemplate.New(name).Funcs(htemplate.FuncMap(defaultFuncs)),
-		subjects:       ttemplate.New(name).Funcs(defaultFuncs),
-		Lookups:        make(map[string]*Lookup),
-		Macros:         make(map[string]*Macro),
-	}
-	c.tree, err = parse.Parse(name, text)
+		Name:             name,
+		CheckFrequency:   time.Minute * 5,
+		HttpListen:       ":8070",
+		WebDir:           "web",
+		StateFile:        "bosun.state",
+		ResponseLimit:    1 << 20, // 1MB
+		QueryConcurrency: 8,
+		CheckConcurrency: 4,
+		QueryCacheTTL:    time.Minute,
+		Vars:             make(map[string]string),
+		Templates:        make(map[string]*Template),
+		Alerts:           make(map[string]*Alert),
+		Notifications:    make(map[string]*Notification),
+		RawText:          text,
+		bodies:           htemplate.New(name).Funcs(htemplate.FuncMap(defaultFuncs)),
+		subjects:         ttemplate.New(name).Funcs(defaultFuncs),
+		Lookups:          make(map[string]*Lookup),
+		Macros:           make(map[string]*Macro),
+		alertDefs:        make(map[string]*alertDef),
+		noFiles:          noFiles,
+	}
+	if noFiles {
+		c.tree, err = parse.ParseNoInclude(name, text)
+	} else {
+		c.tree, err = parse.Parse(name, text)
+	}
 	if err != nil {
 		c.error(err)
 	}
+	c.RawText = c.tree.ExpandedText()
 	saw := make(map[string]bool)
 	for _, n := range c.tree.Root.Nodes {
 		c.at(n)
@@ -349,6 +384,8 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 		c.CheckFrequency = d
 	case "tsdbHost":
 		c.TsdbHost = v
+	case "graphiteHost":
+		c.GraphiteHost = v
 	case "httpListen":
 		c.HttpListen = v
 	case "relayListen":
@@ -383,6 +420,65 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 			c.errorf("responseLimit must be > 0")
 		}
 		c.ResponseLimit = i
+	case "queryConcurrency":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i <= 0 {
+			c.errorf("queryConcurrency must be > 0")
+		}
+		c.QueryConcurrency = i
+	case "checkConcurrency":
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			c.error(err)
+		}
+		if i <= 0 {
+			c.errorf("checkConcurrency must be > 0")
+		}
+		c.CheckConcurrency = i
+	case "alertTimeout":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		d := time.Duration(od)
+		if d < time.Second {
+			c.errorf("alertTimeout duration must be at least 1s")
+		}
+		c.AlertTimeout = d
+	case "queryCacheSize":
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			c.error(err)
+		}
+		if i < 0 {
+			c.errorf("queryCacheSize must be >= 0")
+		}
+		c.QueryCacheSize = i
+	case "queryCacheTTL":
+		od, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			c.error(err)
+		}
+		d := time.Duration(od)
+		if d < time.Second {
+			c.errorf("queryCacheTTL duration must be at least 1s")
+		}
+		c.QueryCacheTTL = d
+	case "reloadTokenFile":
+		if c.noFiles {
+			c.errorf("reloadTokenFile not allowed")
+		}
+		b, err := ioutil.ReadFile(v)
+		if err != nil {
+			c.error(err)
+		}
+		c.ReloadToken = strings.TrimSpace(string(b))
+		if c.ReloadToken == "" {
+			c.errorf("reloadTokenFile is empty: %s", v)
+		}
 	case "unknownTemplate":
 		c.unknownTemplate = v
 		t, ok := c.Templates[c.unknownTemplate]
@@ -405,6 +501,9 @@ func (c *Conf) loadGlobal(p *parse.PairNode) {
 }
 
 func (c *Conf) loadSection(s *parse.SectionNode) {
+	if s.Extends != nil && s.SectionType.Text != "alert" {
+		c.errorf("only alerts may extend another section")
+	}
 	switch s.SectionType.Text {
 	case "template":
 		c.loadTemplate(s)
@@ -434,7 +533,7 @@ const (
 	sMacro
 )
 
-func (c *Conf) getPairs(s *parse.SectionNode, vars Vars, st sectionType, used *[]string) []nodePair {
+func (c *Conf) getPairs(nodes []parse.Node, vars Vars, st sectionType, used *[]string) []nodePair {
 	saw := make(map[string]bool)
 	var pairs []nodePair
 	ignoreBadExpand := st == sMacro
@@ -453,7 +552,7 @@ func (c *Conf) getPairs(s *parse.SectionNode, vars Vars, st sectionType, used *[
 			})
 		}
 	}
-	for _, n := range s.Nodes.Nodes {
+	for _, n := range nodes {
 		c.at(n)
 		switch n := n.(type) {
 		case *parse.PairNode:
@@ -557,7 +656,7 @@ func (c *Conf) loadMacro(s *parse.SectionNode) {
 		Name:   name,
 		Macros: make([]string, 0),
 	}
-	for _, p := range c.getPairs(s, nil, sMacro, &m.Macros) {
+	for _, p := range c.getPairs(s.Nodes.Nodes, nil, sMacro, &m.Macros) {
 		m.Pairs = append(m.Pairs, p)
 	}
 	c.at(s)
@@ -646,13 +745,172 @@ func (c *Conf) loadTemplate(s *parse.SectionNode) {
 
 var lookupNotificationRE = regexp.MustCompile(`^lookup\("(.*)", "(.*)"\)$`)
 
+// alertDef is the definition of an alert, which other alerts may extend.
+type alertDef struct {
+	// Pairs of the alert, merged with those of the alerts it extends.
+	nodes []parse.Node
+	// Text of the alert. If it extends another alert, this is a single alert
+	// section holding the merged pairs.
+	text string
+}
+
+// alertNodes returns the pairs of alert section s merged with those of the
+// alert it extends, and whether s is abstract. A variable of s replaces the
+// variable of the same name where the extended alert defines it, so the values
+// that follow use the new value. Variables are then ordered so each follows
+// the variables it uses, which lets the extended alert use variables only s
+// defines. Any other key of s replaces all values of that key in the extended
+// alert, so a squelch or critNotification of s replaces, rather than adds to,
+// those of the extended alert.
+func (c *Conf) alertNodes(s *parse.SectionNode) (nodes []parse.Node, abstract bool) {
+	var own []parse.Node
+	for _, n := range s.Nodes.Nodes {
+		if p, ok := n.(*parse.PairNode); ok && p.Key.Text == "abstract" {
+			c.at(p)
+			b, err := strconv.ParseBool(p.Val.Text)
+			if err != nil {
+				c.errorf("abstract must be true or false")
+			}
+			abstract = b
+			continue
+		}
+		own = append(own, n)
+	}
+	if s.Extends == nil {
+		return own, abstract
+	}
+	base, ok := c.alertDefs[s.Extends.Text]
+	if !ok {
+		c.errorf("extended alert not found: %s", s.Extends.Text)
+	}
+	key := func(n parse.Node) string {
+		if p, ok := n.(*parse.PairNode); ok {
+			return p.Key.Text
+		}
+		return ""
+	}
+	// Variables and macros keep their order, since values are expanded with
+	// the variables defined before them. Other keys follow them.
+	ordered := func(k string) bool {
+		return strings.HasPrefix(k, "$") || k == "macro"
+	}
+	keys := make(map[string]parse.Node)
+	for _, n := range own {
+		keys[key(n)] = n
+	}
+	var pairs []parse.Node
+	replaced := make(map[parse.Node]bool)
+	for _, n := range base.nodes {
+		k := key(n)
+		switch o := keys[k]; {
+		case strings.HasPrefix(k, "$") && o != nil:
+			nodes = append(nodes, o)
+			replaced[o] = true
+		case ordered(k):
+			nodes = append(nodes, n)
+		case o == nil:
+			pairs = append(pairs, n)
+		}
+	}
+	for _, n := range own {
+		if replaced[n] {
+			continue
+		}
+		if ordered(key(n)) {
+			nodes = append(nodes, n)
+		} else {
+			pairs = append(pairs, n)
+		}
+	}
+	return append(sortVars(nodes), pairs...), abstract
+}
+
+// sortVars returns nodes, variable and macro pairs, reordered so that each
+// variable follows the variables its value uses. Otherwise the order is kept.
+// A variable using itself refers to the global variable of that name.
+func sortVars(nodes []parse.Node) []parse.Node {
+	name := func(n parse.Node) string {
+		if p, ok := n.(*parse.PairNode); ok && strings.HasPrefix(p.Key.Text, "$") {
+			return p.Key.Text
+		}
+		return ""
+	}
+	defined := make(map[string]bool)
+	for _, n := range nodes {
+		defined[name(n)] = true
+	}
+	uses := func(n parse.Node) []string {
+		p, ok := n.(*parse.PairNode)
+		if !ok {
+			return nil
+		}
+		var u []string
+		for _, v := range exRE.FindAllString(p.Val.Text, -1) {
+			if strings.HasPrefix(v, "${") {
+				v = "$" + v[2:len(v)-1]
+			}
+			if v != name(n) && defined[v] {
+				u = append(u, v)
+			}
+		}
+		return u
+	}
+	var sorted []parse.Node
+	done := make(map[string]bool)
+	for len(nodes) > 0 {
+		// Take the first node whose variables are all defined, or the
+		// first node if there is a cycle, which fails on expansion.
+		next := 0
+	Search:
+		for i, n := range nodes {
+			for _, v := range uses(n) {
+				if !done[v] {
+					continue Search
+				}
+			}
+			next = i
+			break
+		}
+		n := nodes[next]
+		sorted = append(sorted, n)
+		done[name(n)] = true
+		nodes = append(nodes[:next:next], nodes[next+1:]...)
+	}
+	return sorted
+}
+
+// alertText returns the definition of alert name with the merged pairs nodes
+// as a single section.
+func alertText(name string, nodes []parse.Node) string {
+	s := "alert " + name + " {\n"
+	for _, n := range nodes {
+		if p, ok := n.(*parse.PairNode); ok {
+			s += "\t" + p.Key.Text + " = " + p.Val.Quoted + "\n"
+		}
+	}
+	return s + "}"
+}
+
 func (c *Conf) loadAlert(s *parse.SectionNode) {
 	name := s.Name.Text
-	if _, ok := c.Alerts[name]; ok {
+	if _, ok := c.alertDefs[name]; ok {
 		c.errorf("duplicate alert name: %s", name)
 	}
+	nodes, abstract := c.alertNodes(s)
+	def := &alertDef{
+		nodes: nodes,
+		text:  s.RawText,
+	}
+	if s.Extends != nil {
+		def.text = alertText(name, nodes)
+	}
+	c.alertDefs[name] = def
+	if abstract {
+		// Only checked when extended.
+		return
+	}
 	a := Alert{
-		Def:              s.RawText,
+		Def:              def.text,
 		Vars:             make(map[string]string),
 		Name:             name,
 		Macros:           make([]string, 0),
@@ -692,7 +950,7 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 			ns.Notifications[k] = v
 		}
 	}
-	for _, p := range c.getPairs(s, a.Vars, sNormal, &a.Macros) {
+	for _, p := range c.getPairs(nodes, a.Vars, sNormal, &a.Macros) {
 		c.at(p.node)
 		v := p.val
 		switch p.key {
@@ -748,6 +1006,44 @@ func (c *Conf) loadAlert(s *parse.SectionNode) {
 				c.errorf("unknown duration must be at least 1s")
 			}
 			a.Unknown = d
+		case "runEvery":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			d := time.Duration(od)
+			if d < time.Second {
+				c.errorf("runEvery duration must be at least 1s")
+			}
+			a.RunEvery = d
+		case "maxQueries":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i <= 0 {
+				c.errorf("maxQueries must be > 0")
+			}
+			a.MaxQueries = i
+		case "maxDatapoints":
+			i, err := strconv.Atoi(v)
+			if err != nil {
+				c.error(err)
+			}
+			if i <= 0 {
+				c.errorf("maxDatapoints must be > 0")
+			}
+			a.MaxDatapoints = i
+		case "maxDuration":
+			od, err := opentsdb.ParseDuration(v)
+			if err != nil {
+				c.error(err)
+			}
+			d := time.Duration(od)
+			if d < time.Second {
+				c.errorf("maxDuration must be at least 1s")
+			}
+			a.MaxDuration = d
 		case "unjoinedOk":
 			a.UnjoinedOK = true
 		case "ignoreUnknown":
@@ -786,7 +1082,7 @@ func (c *Conf) loadNotification(s *parse.SectionNode) {
 		},
 	}
 	c.Notifications[name] = &n
-	for _, p := range c.getPairs(s, n.Vars, sNormal, nil) {
+	for _, p := range c.getPairs(s.Nodes.Nodes, n.Vars, sNormal, nil) {
 		c.at(p.node)
 		v := p.val
 		switch k := p.key; k {
@@ -1044,7 +1340,7 @@ func (c *Conf) AlertTemplateStrings() (*AlertTemplateStrings, error) {
 		if alert.Warn != nil {
 			walk(alert.Warn.Tree.Root)
 		}
-		alerts[name] += alert.Def
+		alerts[name] += c.alertDefs[name].text
 		if alert.Template != nil {
 			t_associations[alert.Name] = alert.Template.Name
 		}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
@@ -63,9 +64,12 @@ func checkMacroVarAlert(t *testing.T, a *Alert) {
 
 func TestInvalid(t *testing.T) {
 	names := map[string]string{
-		"lookup-key-pairs":     "conf: lookup-key-pairs:3:1: at <entry a=3 { }>: lookup tags mismatch, expected {a=,b=}",
-		"number-func-args":     `conf: number-func-args:2:1: at <warn = q("", "") > 0>: expr: parse: not enough arguments for q`,
-		"lookup-key-pairs-dup": `conf: lookup-key-pairs-dup:3:1: at <entry b=2,a=1 { }>: duplicate entry`,
+		"lookup-key-pairs":         "conf: invalid/lookup-key-pairs:3:1: at <entry a=3 { }>: lookup tags mismatch, expected {a=,b=}",
+		"number-func-args":         `conf: invalid/number-func-args:2:1: at <warn = q("", "") > 0>: expr: parse: not enough arguments for q`,
+		"lookup-key-pairs-dup":     `conf: invalid/lookup-key-pairs-dup:3:1: at <entry b=2,a=1 { }>: duplicate entry`,
+		"include-number-func-args": `conf: invalid/number-func-args:2:1: at <warn = q("", "") > 0>: expr: parse: not enough arguments for q`,
+		"extends-missing":          `conf: invalid/extends-missing:1:0: at <alert a extends b {\...>: extended alert not found: b`,
+		"extends-template":         `conf: invalid/extends-template:5:0: at <template b extends a...>: only alerts may extend another section`,
 	}
 	for fname, reason := range names {
 		path := filepath.Join("invalid", fname)
@@ -73,7 +77,7 @@ func TestInvalid(t *testing.T) {
 		if err != nil {
 			t.Fatal(err)
 		}
-		_, err = New(fname, string(b))
+		_, err = New(path, string(b))
 		if err == nil {
 			t.Error("expected error in", path)
 			continue
@@ -84,6 +88,151 @@ func TestInvalid(t *testing.T) {
 	}
 }
 
+func TestNoInclude(t *testing.T) {
+	for _, text := range []string{
+		"include = other.conf",
+		"reloadTokenFile = /etc/bosun/token",
+	} {
+		_, err := NewNoInclude("test", "tsdbHost = localhost:4242\n"+text)
+		if err == nil || !strings.Contains(err.Error(), "not allowed") {
+			t.Errorf("%s: expected not allowed error, got %v", text, err)
+		}
+	}
+}
+
+func TestExtends(t *testing.T) {
+	c, err := New("test", `tsdbHost = localhost:4242
+		notification a {
+			print = true
+		}
+		notification b {
+			print = true
+		}
+		alert disk.base {
+			abstract = true
+			$free = avg(q("avg:disk.free{host=*}", "5m", ""))
+			crit = $free < $threshold
+			critNotification = a
+			squelch = host=x
+		}
+		alert disk.web extends disk.base {
+			$threshold = 10
+			critNotification = b
+		}
+		alert disk.db extends disk.web {
+			$threshold = 20
+			warn = $free < $threshold * 2
+			squelch = host=y
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Alerts["disk.base"]; ok {
+		t.Error("abstract alert was loaded")
+	}
+	web, db := c.Alerts["disk.web"], c.Alerts["disk.db"]
+	if web == nil || db == nil {
+		t.Fatalf("missing alerts: %v", c.Alerts)
+	}
+	if s := web.Crit.String(); s != `avg(q("avg:disk.free{host=*}", "5m", "")) < 10` {
+		t.Errorf("bad disk.web crit: %v", s)
+	}
+	if s := db.Crit.String(); s != `avg(q("avg:disk.free{host=*}", "5m", "")) < 20` {
+		t.Errorf("bad disk.db crit: %v", s)
+	}
+	if db.Warn == nil {
+		t.Error("missing disk.db warn")
+	}
+	for _, a := range []*Alert{web, db} {
+		ns := a.CritNotification.Notifications
+		if len(ns) != 1 || ns["b"] == nil {
+			t.Errorf("%s: expected notification b, got %v", a.Name, ns)
+		}
+	}
+	x, y := opentsdb.TagSet{"host": "x"}, opentsdb.TagSet{"host": "y"}
+	if !c.Squelched(web, x) || c.Squelched(web, y) {
+		t.Error("disk.web should inherit squelch")
+	}
+	if c.Squelched(db, x) || !c.Squelched(db, y) {
+		t.Error("disk.db should override squelch")
+	}
+}
+
+func TestExtendsVars(t *testing.T) {
+	c, err := New("test", `tsdbHost = localhost:4242
+		alert base {
+			abstract = true
+			$q = avg(q("avg:disk.free{host=$host}", "5m", ""))
+			crit = $q < 1
+		}
+		alert web extends base {
+			$host = web*
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	web := c.Alerts["web"]
+	if web == nil {
+		t.Fatalf("missing alert: %v", c.Alerts)
+	}
+	if s := web.Crit.String(); s != `avg(q("avg:disk.free{host=web*}", "5m", "")) < 1` {
+		t.Errorf("bad web crit: %v", s)
+	}
+}
+
+func TestExtendsDef(t *testing.T) {
+	c, err := New("test", `tsdbHost = localhost:4242
+		alert base {
+			abstract = false
+			$t = 1
+			crit = avg(q("avg:m", "5m", "")) > $t
+			squelch = host=x
+		}
+		alert child extends base {
+			$t = 2
+			squelch = host=y
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Alerts["base"] == nil {
+		t.Error("alert with abstract = false was not loaded")
+	}
+	child := c.Alerts["child"]
+	if child == nil {
+		t.Fatalf("missing alert: %v", c.Alerts)
+	}
+	// The definition is a single alert, as the rule page requires.
+	def, err := New("def", "tsdbHost = localhost:4242\n"+child.Def)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := def.Alerts["child"]
+	if len(def.Alerts) != 1 || a == nil {
+		t.Fatalf("expected only alert child, got %v", def.Alerts)
+	}
+	if s := a.Crit.String(); s != child.Crit.String() {
+		t.Errorf("crit: expected %v, got %v", child.Crit, s)
+	}
+	if !def.Squelched(a, opentsdb.TagSet{"host": "y"}) || def.Squelched(a, opentsdb.TagSet{"host": "x"}) {
+		t.Error("bad squelch in definition")
+	}
+	ts, err := c.AlertTemplateStrings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Alerts["child"] != child.Def {
+		t.Errorf("unexpected rule text: %s", ts.Alerts["child"])
+	}
+	if _, err := New("test", `tsdbHost = localhost:4242
+		alert a {
+			abstract = maybe
+			crit = 1
+		}`); err == nil || !strings.Contains(err.Error(), "abstract must be true or false") {
+		t.Errorf("expected abstract error, got %v", err)
+	}
+}
+
 func TestSquelch(t *testing.T) {
 	s := Squelches{
 		[]Squelch{
@@ -0,0 +1,253 @@
+package conf
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+
+	"github.com/bosun-monitor/bosun/conf/parse"
+	"github.com/bosun-monitor/bosun/expr"
+	eparse "github.com/bosun-monitor/bosun/expr/parse"
+)
+
+// keyOrder is the canonical order of the keys of each section type. Keys not
+// listed follow the listed ones.
+var keyOrder = map[string][]string{
+	"alert": {
+		"abstract",
+		"template",
+		"crit",
+		"warn",
+		"critNotification",
+		"warnNotification",
+		"squelch",
+		"unknown",
+		"ignoreUnknown",
+		"unjoinedOk",
+		"runEvery",
+		"maxQueries",
+		"maxDatapoints",
+		"maxDuration",
+	},
+	"notification": {
+		"email",
+		"post",
+		"get",
+		"print",
+		"body",
+		"next",
+		"timeout",
+	},
+	"template": {
+		"subject",
+		"body",
+	},
+}
+
+func init() {
+	keyOrder["macro"] = keyOrder["alert"]
+}
+
+// Format returns text, the configuration file name, in canonical form. Sections
+// and their children are indented with tabs, sections are separated by blank
+// lines, and the keys of a section are sorted into a canonical order. Variables
+// and macros are not moved, and keys are not moved across them, since values
+// are expanded with the variables defined before them. Crit and warn
+// expressions, and variables holding a function call, are normalized if they
+// parse without expansion. Comments are kept with the node that follows them.
+// Include directives are kept and the included files are not read.
+func Format(name, text string) (string, error) {
+	t, err := parse.ParseSource(name, text)
+	if err != nil {
+		return "", err
+	}
+	f := &formatter{text: text}
+	items, trailing := f.items(t.Root.Nodes, 0, len(text))
+	prevSection := false
+	for _, it := range items {
+		_, isSection := it.node.(*parse.SectionNode)
+		if isSection || prevSection {
+			f.blank = true
+		}
+		for _, c := range it.comments {
+			if c == "" {
+				f.blank = true
+			} else {
+				f.line(0, c)
+			}
+		}
+		f.node(it.node, "", 0)
+		prevSection = isSection
+	}
+	if prevSection {
+		f.blank = true
+	}
+	for _, c := range trailing {
+		if c == "" {
+			f.blank = true
+		} else {
+			f.line(0, c)
+		}
+	}
+	return f.buf.String(), nil
+}
+
+type formatter struct {
+	text  string
+	buf   bytes.Buffer
+	blank bool // a blank line precedes the next line
+}
+
+// item is a node and the comments preceding it. Blank lines between the
+// comments are empty strings.
+type item struct {
+	comments []string
+	node     parse.Node
+}
+
+// items returns nodes, which lie between positions start and end of the text,
+// with their comments, and the comments following the last node.
+func (f *formatter) items(nodes []parse.Node, start, end int) ([]item, []string) {
+	var items []item
+	for _, n := range nodes {
+		items = append(items, item{
+			comments: comments(f.text[start:n.Position()]),
+			node:     n,
+		})
+		start = nodeEnd(n)
+	}
+	return items, comments(f.text[start:end])
+}
+
+// line writes s on its own line indented by depth tabs.
+func (f *formatter) line(depth int, s string) {
+	if f.blank && f.buf.Len() > 0 {
+		f.buf.WriteByte('\n')
+	}
+	f.blank = false
+	f.buf.WriteString(strings.Repeat("\t", depth))
+	f.buf.WriteString(s)
+	f.buf.WriteByte('\n')
+}
+
+// node writes n, a child of a section of type section, indented by depth tabs.
+func (f *formatter) node(n parse.Node, section string, depth int) {
+	switch n := n.(type) {
+	case *parse.PairNode:
+		f.line(depth, n.Key.Text+" = "+formatValue(section, n.Key.Text, n.Val))
+	case *parse.SectionNode:
+		header, start := n.SectionType.Text+" "+n.Name.Text, nodeEnd(n.Name)
+		if n.Extends != nil {
+			header, start = header+" extends "+n.Extends.Text, nodeEnd(n.Extends)
+		}
+		f.line(depth, header+" {")
+		closing := int(n.Position()) + len(n.RawText) - 1
+		items, trailing := f.items(n.Nodes.Nodes, start, closing)
+		sortItems(items, n.SectionType.Text)
+		for _, it := range items {
+			for _, c := range it.comments {
+				if c != "" {
+					f.line(depth+1, c)
+				}
+			}
+			f.node(it.node, n.SectionType.Text, depth+1)
+		}
+		for _, c := range trailing {
+			if c != "" {
+				f.line(depth+1, c)
+			}
+		}
+		f.line(depth, "}")
+	}
+}
+
+// sortItems sorts the pairs of items, children of a section of type section,
+// into canonical order between variables, macros and subsections.
+func sortItems(items []item, section string) {
+	order := keyOrder[section]
+	rank := func(it item) int {
+		p := it.node.(*parse.PairNode)
+		for i, k := range order {
+			if k == p.Key.Text {
+				return i
+			}
+		}
+		return len(order)
+	}
+	fixed := func(it item) bool {
+		p, ok := it.node.(*parse.PairNode)
+		return !ok || p.Key.Text == "macro" || strings.HasPrefix(p.Key.Text, "$")
+	}
+	for i := 0; i < len(items); {
+		if fixed(items[i]) {
+			i++
+			continue
+		}
+		j := i
+		for j < len(items) && !fixed(items[j]) {
+			j++
+		}
+		run := items[i:j]
+		sort.Stable(byRank{run, rank})
+		i = j
+	}
+}
+
+type byRank struct {
+	items []item
+	rank  func(item) int
+}
+
+func (b byRank) Len() int           { return len(b.items) }
+func (b byRank) Swap(i, j int)      { b.items[i], b.items[j] = b.items[j], b.items[i] }
+func (b byRank) Less(i, j int) bool { return b.rank(b.items[i]) < b.rank(b.items[j]) }
+
+// formatValue returns the canonical text of v, the value of key in a section
+// of type section. Raw strings are kept as written.
+func formatValue(section, key string, v *parse.StringNode) string {
+	if strings.HasPrefix(v.Quoted, "`") {
+		return v.Quoted
+	}
+	s := strings.TrimSpace(v.Text)
+	isExpr := (section == "alert" || section == "macro") && (key == "crit" || key == "warn")
+	isVar := strings.HasPrefix(key, "$")
+	if !isExpr && !isVar {
+		return s
+	}
+	e, err := expr.New(s)
+	if err != nil || isVar && e.Tree.Root.Type() != eparse.NodeFunc {
+		return s
+	}
+	return e.Tree.Format(0, true)
+}
+
+// comments returns the comment lines of text, which lies between nodes and so
+// holds only comments, delimiters and space. Blank lines are returned as empty
+// strings.
+func comments(text string) []string {
+	var c []string
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimLeft(line, " \t\r{}")
+		switch {
+		case strings.HasPrefix(trimmed, "#"):
+			c = append(c, strings.TrimRight(trimmed, " \t\r"))
+		case i > 0 && i < len(lines)-1 && strings.TrimSpace(line) == "":
+			c = append(c, "")
+		}
+	}
+	return c
+}
+
+// nodeEnd returns the position following n in the text.
+func nodeEnd(n parse.Node) int {
+	switch n := n.(type) {
+	case *parse.PairNode:
+		return nodeEnd(n.Val)
+	case *parse.SectionNode:
+		return int(n.Position()) + len(n.RawText)
+	case *parse.StringNode:
+		return int(n.Position()) + len(n.Quoted)
+	}
+	return int(n.Position())
+}
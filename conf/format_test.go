@@ -0,0 +1,98 @@
+package conf
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	const input = `# global settings
+tsdbHost=localhost:4242
+  include = teams/*.conf
+
+$q=avg(q("avg:os.cpu{host=*}","5m",""))
+notification n { # on call
+print = true
+        email = a@example.com
+}
+alert a {
+	warn = $q>50
+	# page when hot
+	crit=avg(q("avg:m", "5m",""))>(90)
+  template = t
+	$t = 1-2
+	macro = m
+	squelch = host=x
+	critNotification = n
+	# trailing
+}
+alert b   extends a {
+	crit = 1
+	abstract = true
+}
+# end`
+	const expect = `# global settings
+tsdbHost = localhost:4242
+include = teams/*.conf
+
+$q = avg(q("avg:os.cpu{host=*}", "5m", ""))
+
+notification n {
+	email = a@example.com
+	# on call
+	print = true
+}
+
+alert a {
+	template = t
+	# page when hot
+	crit = avg(q("avg:m", "5m", "")) > 90
+	warn = $q>50
+	$t = 1-2
+	macro = m
+	critNotification = n
+	squelch = host=x
+	# trailing
+}
+
+alert b extends a {
+	abstract = true
+	crit = 1
+}
+
+# end
+`
+	got, err := Format("test", input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != expect {
+		t.Errorf("expected:\n%s\ngot:\n%s", expect, got)
+	}
+	again, err := Format("test", got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != got {
+		t.Errorf("format not idempotent:\n%s", again)
+	}
+}
+
+func TestFormatValid(t *testing.T) {
+	fname := "test.conf"
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Setenv("env", "1"); err != nil {
+		t.Fatal(err)
+	}
+	text, err := Format(fname, string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(fname, text); err != nil {
+		t.Fatalf("formatted config is invalid: %v", err)
+	}
+}
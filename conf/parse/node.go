@@ -100,6 +100,7 @@ type SectionNode struct {
 	RawText     string
 	SectionType *StringNode
 	Name        *StringNode
+	Extends     *StringNode // name of the extended section, or nil
 	Nodes       *ListNode
 }
 
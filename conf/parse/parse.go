@@ -9,7 +9,10 @@
 package parse
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -20,22 +23,84 @@ type Tree struct {
 	Name string    // name of the template represented by the tree.
 	Root *ListNode // top-level root of the tree.
 	text string    // text parsed to create the template (or its parent)
+	// files included by the tree. Their node positions follow the end of
+	// text, in order.
+	files []*file
+	// absolute paths of the including files, outermost first, to detect
+	// include cycles.
+	parents []string
+	// keep include pairs in the tree instead of reading the included files.
+	keepIncludes bool
+	// reject include pairs.
+	noIncludes bool
+	// include pairs of text and the expanded text of the files they include.
+	inclusions []inclusion
 	// Parsing only; cleared after parse.
 	lex       *lexer
 	token     [2]item // two-token lookahead for parser.
 	peekCount int
 }
 
+// file is an included file.
+type file struct {
+	name string
+	text string
+	base Pos // position of the start of text
+}
+
+// inclusion is the text of the files included by the include pair between
+// positions start and end of the text of a tree.
+type inclusion struct {
+	start, end int
+	text       string
+}
+
 // Parse returns a Tree, created by parsing the configuration described in the
 // argument string. If an error is encountered, parsing stops and an empty Tree
 // is returned with the error.
 func Parse(name, text string) (t *Tree, err error) {
 	t = New(name)
 	t.text = text
+	if abs, err := filepath.Abs(name); err == nil {
+		t.parents = []string{abs}
+	}
+	err = t.Parse(text)
+	return
+}
+
+// ParseSource is like Parse, but keeps top-level include pairs in the tree
+// instead of reading the included files. It is for tools, like the formatter,
+// that rewrite a single file.
+func ParseSource(name, text string) (t *Tree, err error) {
+	t = New(name)
+	t.keepIncludes = true
 	err = t.Parse(text)
 	return
 }
 
+// ParseNoInclude is like Parse, but rejects include pairs. It is for text from
+// untrusted sources, like the web, which must not read local files.
+func ParseNoInclude(name, text string) (t *Tree, err error) {
+	t = New(name)
+	t.noIncludes = true
+	err = t.Parse(text)
+	return
+}
+
+// ExpandedText returns the text parsed to create t, with each include pair
+// replaced by the text of the files it includes.
+func (t *Tree) ExpandedText() string {
+	var buf bytes.Buffer
+	last := 0
+	for _, in := range t.inclusions {
+		buf.WriteString(t.text[last:in.start])
+		buf.WriteString(in.text)
+		last = in.end
+	}
+	buf.WriteString(t.text[last:])
+	return buf.String()
+}
+
 // next returns the next token.
 func (t *Tree) next() item {
 	if t.peekCount > 0 {
@@ -77,10 +142,18 @@ func New(name string) *Tree {
 	}
 }
 
-// ErrorContext returns a textual representation of the location of the node in the input text.
+// ErrorContext returns a textual representation of the location of the node in
+// the input text. The location of a node from an included file is in that file.
 func (t *Tree) ErrorContext(n Node) (location, context string) {
 	pos := int(n.Position())
-	text := t.text[:pos]
+	name, text, base := t.Name, t.text, 0
+	for _, f := range t.files {
+		if pos >= int(f.base) {
+			name, text, base = f.name, f.text, int(f.base)
+		}
+	}
+	pos -= base
+	text = text[:pos]
 	byteNum := strings.LastIndex(text, "\n")
 	if byteNum == -1 {
 		byteNum = pos // On first line.
@@ -95,7 +168,7 @@ func (t *Tree) ErrorContext(n Node) (location, context string) {
 	if len(context) > 20 {
 		context = fmt.Sprintf("%.20s...", context)
 	}
-	return fmt.Sprintf("%s:%d:%d", t.Name, lineNum, byteNum), context
+	return fmt.Sprintf("%s:%d:%d", name, lineNum, byteNum), context
 }
 
 // errorf formats the error and terminates processing.
@@ -183,7 +256,15 @@ func (t *Tree) parse(root *ListNode) item {
 			switch token2 := t.next(); token2.typ {
 			case itemEqual:
 				t.backup2(token)
-				n = t.parsePair()
+				p := t.parsePair()
+				if root == t.Root && p.Key.Text == "include" && t.noIncludes {
+					t.errorf("include not allowed")
+				}
+				if root == t.Root && p.Key.Text == "include" && !t.keepIncludes {
+					t.include(p)
+					continue
+				}
+				n = p
 			case itemIdentifier, itemSubsectionIdentifier:
 				t.backup2(token)
 				n = t.parseSection()
@@ -207,6 +288,91 @@ func (t *Tree) parse(root *ListNode) item {
 	}
 }
 
+// include parses the files matching the glob pattern of p, relative to the
+// directory of t, and appends their nodes to the root of t.
+func (t *Tree) include(p *PairNode) {
+	pattern := p.Val.Text
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(t.Name), pattern)
+	}
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		t.errorf("include %s: %v", p.Val.Text, err)
+	}
+	if len(names) == 0 && !strings.ContainsAny(pattern, "*?[") {
+		t.errorf("include %s: no such file", p.Val.Text)
+	}
+	var text bytes.Buffer
+	for _, name := range names {
+		abs, err := filepath.Abs(name)
+		if err != nil {
+			t.error(err)
+		}
+		for i, parent := range t.parents {
+			if parent == abs {
+				t.errorf("include cycle: %s", strings.Join(append(t.parents[i:], abs), " -> "))
+			}
+		}
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.error(err)
+		}
+		it := New(name)
+		it.parents = append(t.parents[:len(t.parents):len(t.parents)], abs)
+		if err := it.Parse(string(b)); err != nil {
+			// Already located in the included file.
+			panic(err)
+		}
+		base := t.end()
+		shift(it.Root, base)
+		t.files = append(t.files, &file{name: name, text: it.text, base: base})
+		for _, f := range it.files {
+			t.files = append(t.files, &file{name: f.name, text: f.text, base: f.base + base})
+		}
+		t.Root.Nodes = append(t.Root.Nodes, it.Root.Nodes...)
+		fmt.Fprintf(&text, "# %s\n%s\n", name, strings.TrimRight(it.ExpandedText(), "\n"))
+	}
+	t.inclusions = append(t.inclusions, inclusion{
+		start: int(p.Pos),
+		end:   int(p.Val.Pos) + len(p.Val.Quoted),
+		text:  strings.TrimRight(text.String(), "\n"),
+	})
+}
+
+// end returns the position after the text of t and its included files.
+func (t *Tree) end() Pos {
+	if len(t.files) == 0 {
+		return Pos(len(t.text))
+	}
+	f := t.files[len(t.files)-1]
+	return f.base + Pos(len(f.text))
+}
+
+// shift moves the position of n and its children by d.
+func shift(n Node, d Pos) {
+	switch n := n.(type) {
+	case *ListNode:
+		n.Pos += d
+		for _, c := range n.Nodes {
+			shift(c, d)
+		}
+	case *PairNode:
+		n.Pos += d
+		shift(n.Key, d)
+		shift(n.Val, d)
+	case *SectionNode:
+		n.Pos += d
+		shift(n.SectionType, d)
+		shift(n.Name, d)
+		if n.Extends != nil {
+			shift(n.Extends, d)
+		}
+		shift(n.Nodes, d)
+	case *StringNode:
+		n.Pos += d
+	}
+}
+
 func (t *Tree) parsePair() *PairNode {
 	const context = "key=value declaration"
 	token := t.expect(itemIdentifier, context)
@@ -237,6 +403,12 @@ func (t *Tree) parseSection() *SectionNode {
 	s.SectionType = newString(token.pos, token.val, token.val)
 	token = t.expectOneOf(itemIdentifier, itemSubsectionIdentifier, context)
 	s.Name = newString(token.pos, token.val, token.val)
+	if token = t.next(); token.typ == itemIdentifier && token.val == "extends" {
+		token = t.expectOneOf(itemIdentifier, itemSubsectionIdentifier, context)
+		s.Extends = newString(token.pos, token.val, token.val)
+	} else {
+		t.backup()
+	}
 	t.expect(itemLeftDelim, context)
 	token = t.parse(s.Nodes)
 	s.RawText = t.text[start : token.pos+1]
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -44,3 +45,83 @@ func _TestPrint(t *testing.T) {
 		fmt.Print(c.Root)
 	}
 }
+
+func TestInclude(t *testing.T) {
+	fname := filepath.Join("test_include", "main")
+	b, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := Parse(fname, string(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []struct {
+		name     string
+		location string
+	}{
+		{"tsdbHost", "test_include/main:1:0"},
+		{"a", "test_include/teams/a.conf:1:0"},
+		{"common", "test_include/common:2:0"},
+		{"b", "test_include/teams/b.conf:2:0"},
+		{"main", "test_include/main:4:0"},
+	}
+	if len(tree.Root.Nodes) != len(expect) {
+		t.Fatalf("expected %v nodes, got %v:\n%s", len(expect), len(tree.Root.Nodes), tree.Root)
+	}
+	for i, n := range tree.Root.Nodes {
+		var name string
+		switch n := n.(type) {
+		case *PairNode:
+			name = n.Key.Text
+		case *SectionNode:
+			name = n.Name.Text
+		}
+		location, _ := tree.ErrorContext(n)
+		if name != expect[i].name || location != expect[i].location {
+			t.Errorf("node %v: expected %v at %v, got %v at %v", i, expect[i].name, expect[i].location, name, location)
+		}
+	}
+	if s := tree.Root.Nodes[3].(*SectionNode); s.RawText != "alert b {\n\tcrit = 2\n}" {
+		t.Errorf("unexpected raw text: %q", s.RawText)
+	}
+	expanded := `tsdbHost = localhost:4242
+# test_include/teams/a.conf
+alert a {
+	crit = 1
+}
+# test_include/common
+# Shared by all teams.
+macro common {
+	warn = 0
+}
+# test_include/teams/b.conf
+
+alert b {
+	crit = 2
+}
+
+alert main {
+	crit = 1
+}
+`
+	if text := tree.ExpandedText(); text != expanded {
+		t.Errorf("unexpected expanded text:\n%s", text)
+	}
+	if _, err := ParseNoInclude(fname, expanded); err != nil {
+		t.Errorf("expanded text: %v", err)
+	}
+	if _, err := ParseNoInclude(fname, string(b)); err == nil || !strings.Contains(err.Error(), "include not allowed") {
+		t.Errorf("expected include not allowed error, got %v", err)
+	}
+	fname = filepath.Join("test_include", "cycle")
+	if _, err := Parse(fname, "include = cycle2"); err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("expected include cycle error, got %v", err)
+	}
+	if _, err := Parse(fname, "include = missing"); err == nil {
+		t.Error("expected error for missing include")
+	}
+	if _, err := Parse(fname, "include = missing*"); err != nil {
+		t.Errorf("unexpected error for empty glob: %v", err)
+	}
+}
@@ -6,11 +6,15 @@ import (
 	"math"
 	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/bosun-monitor/bosun/_third_party/github.com/MiniProfiler/go/miniprofiler"
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
 	"github.com/bosun-monitor/bosun/expr/parse"
+	"github.com/bosun-monitor/bosun/graphite"
 	"github.com/bosun-monitor/bosun/search"
 )
 
@@ -21,13 +25,58 @@ type state struct {
 	now        time.Time
 	autods     int
 	context    opentsdb.Context
+	graphite   graphite.Context
 	queries    []opentsdb.Request
 	unjoinedOk bool
 	squelched  func(tags opentsdb.TagSet) bool
+	bindings   map[*parse.LetNode]*binding
+	// traces holds the trace of each evaluated node. It is nil unless the
+	// expression is being explained.
+	traces map[parse.Node]*Trace
+	sync.Mutex
+}
+
+// binding holds the value of a let binding, which is evaluated at most once
+// per execution.
+type binding struct {
+	once  sync.Once
+	res   *Results
+	panic interface{}
 }
 
 func (e *state) addRequest(r opentsdb.Request) {
+	e.Lock()
 	e.queries = append(e.queries, r)
+	e.Unlock()
+}
+
+// parallel calls each function in its own goroutine and waits for all of them
+// to return. If any function panics, the first panic is re-raised in the
+// caller once all functions have returned.
+func parallel(fns ...func()) {
+	if len(fns) == 1 {
+		fns[0]()
+		return
+	}
+	var wg sync.WaitGroup
+	var once sync.Once
+	var p interface{}
+	wg.Add(len(fns))
+	for _, f := range fns {
+		go func(f func()) {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					once.Do(func() { p = r })
+				}
+			}()
+			f()
+		}(f)
+	}
+	wg.Wait()
+	if p != nil {
+		panic(p)
+	}
 }
 
 var ErrUnknownOp = fmt.Errorf("expr: unknown op type")
@@ -51,9 +100,20 @@ func New(expr string) (*Expr, error) {
 	return e, nil
 }
 
-// Execute applies a parse expression to the specified OpenTSDB context, and
-// returns one result per group. T may be nil to ignore timings.
-func (e *Expr) Execute(c opentsdb.Context, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, lookups map[string]*Lookup, squelched func(tags opentsdb.TagSet) bool) (r *Results, queries []opentsdb.Request, err error) {
+// Execute applies a parse expression to the specified OpenTSDB and Graphite
+// contexts, and returns one result per group. T may be nil to ignore timings.
+func (e *Expr) Execute(c opentsdb.Context, g graphite.Context, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, lookups map[string]*Lookup, squelched func(tags opentsdb.TagSet) bool) (r *Results, queries []opentsdb.Request, err error) {
+	r, queries, _, err = e.execute(c, g, T, now, autods, unjoinedOk, search, lookups, squelched, false)
+	return
+}
+
+// Explain is like Execute, but also returns a trace of the evaluation of each
+// node of the expression.
+func (e *Expr) Explain(c opentsdb.Context, g graphite.Context, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, lookups map[string]*Lookup, squelched func(tags opentsdb.TagSet) bool) (*Results, []opentsdb.Request, *Trace, error) {
+	return e.execute(c, g, T, now, autods, unjoinedOk, search, lookups, squelched, true)
+}
+
+func (e *Expr) execute(c opentsdb.Context, g graphite.Context, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, search *search.Search, lookups map[string]*Lookup, squelched func(tags opentsdb.TagSet) bool, explain bool) (r *Results, queries []opentsdb.Request, trace *Trace, err error) {
 	defer errRecover(&err)
 	if squelched == nil {
 		squelched = func(tags opentsdb.TagSet) bool {
@@ -63,12 +123,17 @@ func (e *Expr) Execute(c opentsdb.Context, T miniprofiler.Timer, now time.Time,
 	s := &state{
 		Expr:       e,
 		context:    c,
+		graphite:   g,
 		now:        now,
 		autods:     autods,
 		unjoinedOk: unjoinedOk,
 		search:     search,
 		lookups:    lookups,
 		squelched:  squelched,
+		bindings:   make(map[*parse.LetNode]*binding),
+	}
+	if explain {
+		s.traces = make(map[parse.Node]*Trace)
 	}
 	if T == nil {
 		T = new(miniprofiler.Profile)
@@ -77,6 +142,9 @@ func (e *Expr) Execute(c opentsdb.Context, T miniprofiler.Timer, now time.Time,
 		r = s.walk(e.Tree.Root, T)
 	})
 	queries = s.queries
+	if explain {
+		trace = s.buildTrace(e.Tree.Root)
+	}
 	return
 }
 
@@ -129,6 +197,111 @@ type Series map[string]opentsdb.Point
 func (s Series) Type() parse.FuncType { return parse.TYPE_SERIES }
 func (s Series) Value() interface{}   { return s }
 
+type seriesPoint struct {
+	T int64
+	V float64
+}
+
+// sorted returns the points of s in ascending timestamp order.
+func (s Series) sorted() []seriesPoint {
+	pts := make([]seriesPoint, 0, len(s))
+	for k, v := range s {
+		t, err := strconv.ParseInt(k, 10, 64)
+		if err != nil {
+			panic(err)
+		}
+		pts = append(pts, seriesPoint{t, float64(v)})
+	}
+	sort.Sort(byTime(pts))
+	return pts
+}
+
+type byTime []seriesPoint
+
+func (b byTime) Len() int           { return len(b) }
+func (b byTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byTime) Less(i, j int) bool { return b[i].T < b[j].T }
+
+// Alignment determines how the timestamps of two series are matched when a
+// binary operator is applied to them.
+type Alignment int
+
+const (
+	// AlignExact only uses timestamps present in both series.
+	AlignExact Alignment = iota
+	// AlignNearest pairs each point of the left series with the point of the
+	// right series closest in time.
+	AlignNearest
+	// AlignInterpolate linearly interpolates the right series at each
+	// timestamp of the left series. Points outside the range of the right
+	// series are dropped.
+	AlignInterpolate
+)
+
+func (a Alignment) String() string {
+	switch a {
+	case AlignExact:
+		return "exact"
+	case AlignNearest:
+		return "nearest"
+	case AlignInterpolate:
+		return "interpolate"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAlignment returns the Alignment named by s.
+func ParseAlignment(s string) (Alignment, error) {
+	switch s {
+	case "exact":
+		return AlignExact, nil
+	case "nearest":
+		return AlignNearest, nil
+	case "interpolate":
+		return AlignInterpolate, nil
+	}
+	return AlignExact, fmt.Errorf("expr: unknown alignment %s", s)
+}
+
+// operateSeries applies op to each pair of points from a and b, matched by
+// align. The result has the timestamps of a.
+func operateSeries(op string, a, b Series, align Alignment) Series {
+	s := make(Series)
+	if align == AlignExact {
+		for k, av := range a {
+			if bv, ok := b[k]; ok {
+				s[k] = opentsdb.Point(operate(op, float64(av), float64(bv)))
+			}
+		}
+		return s
+	}
+	bp := b.sorted()
+	if len(bp) == 0 {
+		return s
+	}
+	for _, p := range a.sorted() {
+		i := sort.Search(len(bp), func(i int) bool { return bp[i].T >= p.T })
+		var bv float64
+		switch {
+		case i < len(bp) && bp[i].T == p.T:
+			bv = bp[i].V
+		case align == AlignNearest:
+			if i == len(bp) || (i > 0 && p.T-bp[i-1].T <= bp[i].T-p.T) {
+				i--
+			}
+			bv = bp[i].V
+		case i == 0 || i == len(bp):
+			continue
+		default:
+			l, r := bp[i-1], bp[i]
+			bv = l.V + (r.V-l.V)*float64(p.T-l.T)/float64(r.T-l.T)
+		}
+		s[strconv.FormatInt(p.T, 10)] = opentsdb.Point(operate(op, p.V, bv))
+	}
+	return s
+}
+
 type Result struct {
 	Computations
 	Value
@@ -143,6 +316,9 @@ type Results struct {
 	IgnoreOtherUnjoined bool
 	// If non nil, will set any NaN value to it.
 	NaNValue *float64
+	// Align determines how timestamps are matched when this set is combined
+	// with another series.
+	Align Alignment
 }
 
 func (r *Results) NaN() Number {
@@ -186,8 +362,9 @@ func (u *Union) ExtendComputations(o *Result) {
 }
 
 // union returns the combination of a and b where one is a subset of the other.
-func (e *state) union(a, b *Results, expression string) []*Union {
+func (e *state) union(a, b *Results, node parse.Node) []*Union {
 	const unjoinedGroup = "unjoined group (%v)"
+	expression := node.String()
 	var us []*Union
 	if len(a.Results) == 0 || len(b.Results) == 0 {
 		return us
@@ -221,41 +398,54 @@ func (e *state) union(a, b *Results, expression string) []*Union {
 			}
 			delete(am, ra)
 			delete(bm, rb)
+			e.traceJoin(node, Join{Group: u.Group, A: ra.Group, B: rb.Group})
 			u.ExtendComputations(ra)
 			u.ExtendComputations(rb)
 			us = append(us, u)
 		}
 	}
-	if !e.unjoinedOk {
-		if !a.IgnoreUnjoined && !b.IgnoreOtherUnjoined {
-			for r := range am {
-				u := &Union{
-					A:     r.Value,
-					B:     b.NaN(),
-					Group: r.Group,
-				}
-				r.AddComputation(expression, fmt.Sprintf(unjoinedGroup, u.B))
-				u.ExtendComputations(r)
-				us = append(us, u)
-			}
+	keepA := !e.unjoinedOk && !a.IgnoreUnjoined && !b.IgnoreOtherUnjoined
+	for r := range am {
+		e.traceJoin(node, Join{Group: r.Group, A: r.Group, Unjoined: true, Dropped: !keepA})
+		if !keepA {
+			continue
 		}
-		if !b.IgnoreUnjoined && !a.IgnoreOtherUnjoined {
-			for r := range bm {
-				u := &Union{
-					A:     a.NaN(),
-					B:     r.Value,
-					Group: r.Group,
-				}
-				r.AddComputation(expression, fmt.Sprintf(unjoinedGroup, u.A))
-				u.ExtendComputations(r)
-				us = append(us, u)
-			}
+		u := &Union{
+			A:     r.Value,
+			B:     b.NaN(),
+			Group: r.Group,
+		}
+		r.AddComputation(expression, fmt.Sprintf(unjoinedGroup, u.B))
+		u.ExtendComputations(r)
+		us = append(us, u)
+	}
+	keepB := !e.unjoinedOk && !b.IgnoreUnjoined && !a.IgnoreOtherUnjoined
+	for r := range bm {
+		e.traceJoin(node, Join{Group: r.Group, B: r.Group, Unjoined: true, Dropped: !keepB})
+		if !keepB {
+			continue
 		}
+		u := &Union{
+			A:     a.NaN(),
+			B:     r.Value,
+			Group: r.Group,
+		}
+		r.AddComputation(expression, fmt.Sprintf(unjoinedGroup, u.A))
+		u.ExtendComputations(r)
+		us = append(us, u)
 	}
 	return us
 }
 
-func (e *state) walk(node parse.Node, T miniprofiler.Timer) *Results {
+func (e *state) walk(node parse.Node, T miniprofiler.Timer) (res *Results) {
+	if e.traces != nil {
+		start := time.Now()
+		defer func() {
+			if res != nil {
+				e.traceResults(node, res, time.Since(start))
+			}
+		}()
+	}
 	switch node := node.(type) {
 	case *parse.NumberNode:
 		return wrap(node.Float64)
@@ -265,19 +455,34 @@ func (e *state) walk(node parse.Node, T miniprofiler.Timer) *Results {
 		return e.walkUnary(node, T)
 	case *parse.FuncNode:
 		return e.walkFunc(node, T)
+	case *parse.TernaryNode:
+		return e.walkTernary(node, T)
+	case *parse.LetNode:
+		return e.walk(node.Body, T)
+	case *parse.VarNode:
+		return e.walkVar(node, T)
 	default:
 		panic(fmt.Errorf("expr: unknown node type"))
 	}
 }
 
 func (e *state) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) *Results {
-	ar := e.walk(node.Args[0], T)
-	br := e.walk(node.Args[1], T)
+	var ar, br *Results
+	parallel(
+		func() { ar = e.walk(node.Args[0], T) },
+		func() { br = e.walk(node.Args[1], T) },
+	)
 	res := Results{
 		IgnoreUnjoined:      ar.IgnoreUnjoined || br.IgnoreUnjoined,
 		IgnoreOtherUnjoined: ar.IgnoreOtherUnjoined || br.IgnoreOtherUnjoined,
 	}
-	u := e.union(ar, br, node.String())
+	// The alignment of an operand only applies to this operation, not to
+	// operations on its result.
+	align := ar.Align
+	if align == AlignExact {
+		align = br.Align
+	}
+	u := e.union(ar, br, node)
 	for _, v := range u {
 		var value Value
 		r := Result{
@@ -337,6 +542,8 @@ func (e *state) walkBinary(node *parse.BinaryNode, T miniprofiler.Timer) *Result
 						s[k] = opentsdb.Point(operate(node.OpStr, float64(v), bv))
 					}
 					value = s
+				case Series:
+					value = operateSeries(node.OpStr, at, bt, align)
 				default:
 					panic(ErrUnknownOp)
 				}
@@ -458,27 +665,140 @@ func uoperate(op string, a float64) (r float64) {
 	return
 }
 
+// walkVar returns a copy of the value of the let binding referenced by node,
+// evaluating it on first use.
+func (e *state) walkVar(node *parse.VarNode, T miniprofiler.Timer) *Results {
+	e.Lock()
+	b := e.bindings[node.Let]
+	if b == nil {
+		b = new(binding)
+		e.bindings[node.Let] = b
+	}
+	e.Unlock()
+	b.once.Do(func() {
+		defer func() {
+			b.panic = recover()
+		}()
+		b.res = e.walk(node.Let.Value, T)
+		for _, r := range b.res.Results {
+			switch v := r.Value.(type) {
+			case Number:
+				r.AddComputation(node.Let.Name, v)
+			case Scalar:
+				r.AddComputation(node.Let.Name, Number(v))
+			}
+		}
+	})
+	if b.panic != nil {
+		panic(b.panic)
+	}
+	return b.res.copy()
+}
+
+// copy returns a copy of r that can be modified without affecting r. Series
+// values are shared since they are never modified in place.
+func (r *Results) copy() *Results {
+	c := *r
+	c.Results = make([]*Result, len(r.Results))
+	for i, res := range r.Results {
+		nr := *res
+		nr.Computations = append(Computations(nil), res.Computations...)
+		c.Results[i] = &nr
+	}
+	return &c
+}
+
+// ternaryValue holds the condition and true value of a conditional while it
+// is joined with the false value.
+type ternaryValue struct {
+	cond, a Value
+}
+
+func (t ternaryValue) Type() parse.FuncType { return t.a.Type() }
+func (t ternaryValue) Value() interface{}   { return t }
+
+// walkTernary selects, per group, the true or false value depending on the
+// condition. Groups are joined as with binary operators. A NaN condition
+// yields NaN.
+func (e *state) walkTernary(node *parse.TernaryNode, T miniprofiler.Timer) *Results {
+	var cr, ar, br *Results
+	parallel(
+		func() { cr = e.walk(node.Args[0], T) },
+		func() { ar = e.walk(node.Args[1], T) },
+		func() { br = e.walk(node.Args[2], T) },
+	)
+	expression := node.String()
+	ca := &Results{
+		IgnoreUnjoined:      cr.IgnoreUnjoined || ar.IgnoreUnjoined,
+		IgnoreOtherUnjoined: cr.IgnoreOtherUnjoined || ar.IgnoreOtherUnjoined,
+	}
+	for _, u := range e.union(cr, ar, node) {
+		ca.Results = append(ca.Results, &Result{
+			Group:        u.Group,
+			Computations: u.Computations,
+			Value:        ternaryValue{u.A, u.B},
+		})
+	}
+	res := Results{
+		IgnoreUnjoined:      ca.IgnoreUnjoined || br.IgnoreUnjoined,
+		IgnoreOtherUnjoined: ca.IgnoreOtherUnjoined || br.IgnoreOtherUnjoined,
+	}
+	for _, u := range e.union(ca, br, node) {
+		r := Result{
+			Group:        u.Group,
+			Computations: u.Computations,
+		}
+		tv, ok := u.A.(ternaryValue)
+		if !ok {
+			// The false value did not join with the condition.
+			tv = ternaryValue{u.A, u.A}
+		}
+		switch c := reflect.ValueOf(tv.cond).Float(); {
+		case math.IsNaN(c):
+			// An unknown condition selects neither value, but the result
+			// keeps the type of the expression.
+			if node.Return() == parse.TYPE_SERIES {
+				r.Value = make(Series)
+			} else {
+				r.Value = tv.cond
+			}
+		case c != 0:
+			r.Value = tv.a
+		default:
+			r.Value = u.B
+		}
+		if v, ok := r.Value.(Scalar); ok && node.Return() == parse.TYPE_NUMBER {
+			r.Value = Number(v)
+		}
+		switch v := r.Value.(type) {
+		case Number:
+			r.AddComputation(expression, v)
+		case Scalar:
+			r.AddComputation(expression, Number(v))
+		}
+		res.Results = append(res.Results, &r)
+	}
+	return &res
+}
+
 func (e *state) walkFunc(node *parse.FuncNode, T miniprofiler.Timer) *Results {
 	f := reflect.ValueOf(node.F.F)
-	var in []reflect.Value
-	for _, a := range node.Args {
-		var v interface{}
+	in := make([]reflect.Value, len(node.Args))
+	var fns []func()
+	for i, a := range node.Args {
+		i := i
 		switch t := a.(type) {
 		case *parse.StringNode:
-			v = t.Text
+			in[i] = reflect.ValueOf(t.Text)
 		case *parse.NumberNode:
-			v = t.Float64
-		case *parse.FuncNode:
-			v = extractScalar(e.walkFunc(t, T))
-		case *parse.UnaryNode:
-			v = extractScalar(e.walkUnary(t, T))
-		case *parse.BinaryNode:
-			v = extractScalar(e.walkBinary(t, T))
+			in[i] = reflect.ValueOf(t.Float64)
+		case *parse.FuncNode, *parse.UnaryNode, *parse.BinaryNode, *parse.TernaryNode, *parse.LetNode, *parse.VarNode:
+			fns = append(fns, func() { in[i] = reflect.ValueOf(extractScalar(e.walk(t, T))) })
 		default:
 			panic(fmt.Errorf("expr: unknown func arg type"))
 		}
-		in = append(in, reflect.ValueOf(v))
 	}
+	parallel(fns...)
 	fr := f.Call(append([]reflect.Value{reflect.ValueOf(e), reflect.ValueOf(T)}, in...))
 	res := fr[0].Interface().(*Results)
 	if len(fr) > 1 && !fr[1].IsNil() {
@@ -1,10 +1,17 @@
 package expr
 
 import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+	"github.com/bosun-monitor/bosun/fixture"
+	"github.com/bosun-monitor/bosun/graphite"
+	"github.com/bosun-monitor/bosun/search"
 )
 
 func TestExprSimple(t *testing.T) {
@@ -35,6 +42,12 @@ func TestExprSimple(t *testing.T) {
 		{"1>=2", 0},
 		{"-1 > 0", 0},
 		{"-1 < 0", 1},
+		{"1 ? 2 : 3", 2},
+		{"0 ? 2 : 3", 3},
+		{"1 > 2 ? 1 : 2 > 1 ? 2 : 3", 2},
+		{"(0 ? 1 : 2) + 1", 3},
+		{"let x = 2; x * x + 1", 5},
+		{"let x = 2; let x = x + 1; x", 3},
 	}
 
 	for _, et := range exprTests {
@@ -43,7 +56,7 @@ func TestExprSimple(t *testing.T) {
 			t.Error(err)
 			break
 		}
-		r, _, err := e.Execute(opentsdb.Host(""), nil, time.Now(), 0, false, nil, nil, nil)
+		r, _, err := e.Execute(opentsdb.Host(""), graphite.Host(""), nil, time.Now(), 0, false, nil, nil, nil)
 		if err != nil {
 			t.Error(err)
 			break
@@ -77,6 +90,766 @@ func TestExprParse(t *testing.T) {
 	}
 }
 
+// queryContext answers requests by the metric of their first query.
+type queryContext map[string]opentsdb.ResponseSet
+
+func (c queryContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	return c[r.Queries[0].Metric], nil
+}
+
+func TestSeriesOperations(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{
+				Metric: "a",
+				Tags:   opentsdb.TagSet{"host": "x"},
+				DPS:    map[string]opentsdb.Point{"0": 1, "10": 2, "20": 3, "30": 4},
+			},
+			{
+				Metric: "a",
+				Tags:   opentsdb.TagSet{"host": "y"},
+				DPS:    map[string]opentsdb.Point{"0": 10},
+			},
+		},
+		"b": {
+			{
+				Metric: "b",
+				Tags:   opentsdb.TagSet{"host": "x"},
+				DPS:    map[string]opentsdb.Point{"0": 2, "12": 4, "20": 6},
+			},
+		},
+		"c": {
+			{
+				Metric: "c",
+				Tags:   opentsdb.TagSet{"host": "x"},
+				DPS:    map[string]opentsdb.Point{"0": 2, "20": 6},
+			},
+		},
+	}
+	var seriesTests = []struct {
+		input  string
+		output map[string]Series
+	}{
+		{
+			`q("avg:a{host=*}", "1m", "") + q("avg:b{host=*}", "1m", "")`,
+			map[string]Series{
+				"{host=x}": {"0": 3, "20": 9},
+			},
+		},
+		{
+			`q("avg:a{host=*}", "1m", "") * align(q("avg:b{host=*}", "1m", ""), "nearest")`,
+			map[string]Series{
+				"{host=x}": {"0": 2, "10": 8, "20": 18, "30": 24},
+			},
+		},
+		{
+			`q("avg:a{host=x}", "1m", "") - align(q("avg:c{host=x}", "1m", ""), "interpolate")`,
+			map[string]Series{
+				"{host=x}": {"0": -1, "10": -2, "20": -3},
+			},
+		},
+		{
+			`align(q("avg:a{host=x}", "1m", ""), "nearest") + q("avg:b{host=x}", "1m", "") + q("avg:c{host=x}", "1m", "")`,
+			map[string]Series{
+				"{host=x}": {"0": 5, "20": 15},
+			},
+		},
+		{
+			`shift(q("avg:a{host=x}", "1m", ""), "10s")`,
+			map[string]Series{
+				"{host=x}": {"10": 1, "20": 2, "30": 3, "40": 4},
+				"{host=y}": {"10": 10},
+			},
+		},
+		{
+			`q("avg:a{host=x}", "1m", "") - shift(q("avg:a{host=x}", "1m", ""), "10s")`,
+			map[string]Series{
+				"{host=x}": {"10": 1, "20": 1, "30": 1},
+				"{host=y}": {},
+			},
+		},
+		{
+			`q("avg:a{host=x}", "1m", "") > q("avg:b{host=x}", "1m", "") / 2`,
+			map[string]Series{
+				"{host=x}": {"0": 0, "20": 0},
+			},
+		},
+	}
+	for _, st := range seriesTests {
+		e, err := New(st.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(ctx, nil, nil, time.Now(), 0, true, search.NewSearch(), nil, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(r.Results) != len(st.output) {
+			t.Errorf("%v: expected %v groups, got %v", st.input, len(st.output), len(r.Results))
+		}
+		for _, res := range r.Results {
+			expect, ok := st.output[res.Group.String()]
+			if !ok {
+				t.Errorf("%v: unexpected group %v", st.input, res.Group)
+				continue
+			}
+			got := res.Value.(Series)
+			if len(got) != len(expect) {
+				t.Errorf("%v: %v: expected %v, got %v", st.input, res.Group, expect, got)
+				continue
+			}
+			for k, v := range expect {
+				if got[k] != v {
+					t.Errorf("%v: %v: expected %v, got %v", st.input, res.Group, expect, got)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestConditional(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 1}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "y"}, DPS: map[string]opentsdb.Point{"0": 10}},
+		},
+		"b": {
+			{Metric: "b", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 100}},
+		},
+	}
+	var conditionalTests = []struct {
+		input  string
+		output map[string]Number
+	}{
+		{
+			`avg(q("avg:a{host=*}", "1m", "")) > 5 ? avg(q("avg:a{host=*}", "1m", "")) : 0`,
+			map[string]Number{"{host=x}": 0, "{host=y}": 10},
+		},
+		{
+			`avg(q("avg:a{host=*}", "1m", "")) > 5 ? 1 : avg(q("avg:b{host=*}", "1m", ""))`,
+			map[string]Number{"{host=x}": 100, "{host=y}": 1},
+		},
+	}
+	for _, ct := range conditionalTests {
+		e, err := New(ct.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(ctx, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(r.Results) != len(ct.output) {
+			t.Errorf("%v: expected %v results, got %v", ct.input, len(ct.output), len(r.Results))
+		}
+		for _, res := range r.Results {
+			if expect, ok := ct.output[res.Group.String()]; !ok {
+				t.Errorf("%v: unexpected group %v", ct.input, res.Group)
+			} else if res.Value != expect {
+				t.Errorf("%v: %v: expected %v, got %v", ct.input, res.Group, expect, res.Value)
+			}
+		}
+	}
+}
+
+func TestConditionalSeriesNaN(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 1}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "y"}, DPS: map[string]opentsdb.Point{"0": 10}},
+		},
+	}
+	e, err := New(`(avg(q("avg:a{host=*}", "1m", "")) - 1) / 0 ? q("avg:a{host=*}", "1m", "") : q("avg:a{host=*}", "1m", "")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := e.Execute(ctx, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]int{"{host=x}": 0, "{host=y}": 1}
+	if len(r.Results) != len(expect) {
+		t.Fatalf("expected %v results, got %v", len(expect), len(r.Results))
+	}
+	for _, res := range r.Results {
+		s, ok := res.Value.(Series)
+		if !ok {
+			t.Errorf("%v: expected series, got %T", res.Group, res.Value)
+		} else if n := expect[res.Group.String()]; len(s) != n {
+			t.Errorf("%v: expected %v points, got %v", res.Group, n, s)
+		}
+	}
+}
+
+func TestLet(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 1, "10": 3}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "y"}, DPS: map[string]opentsdb.Point{"0": 10}},
+		},
+	}
+	e, err := New(`let x = q("avg:a{host=*}", "1m", ""); let m = max(x); avg(-x) / m + m`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, queries, err := e.Execute(ctx, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(queries) != 1 {
+		t.Errorf("expected 1 query, got %v", len(queries))
+	}
+	expect := map[string]Number{"{host=x}": 3 - 2.0/3, "{host=y}": 9}
+	if len(r.Results) != len(expect) {
+		t.Fatalf("expected %v results, got %v", len(expect), len(r.Results))
+	}
+	for _, res := range r.Results {
+		if v := expect[res.Group.String()]; res.Value != v {
+			t.Errorf("%v: expected %v, got %v", res.Group, v, res.Value)
+		}
+		found := false
+		for _, c := range res.Computations {
+			if c.Text == "m" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%v: missing computation for m: %v", res.Group, res.Computations)
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 1}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "y"}, DPS: map[string]opentsdb.Point{"0": 10}},
+		},
+		"b": {
+			{Metric: "b", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 100}},
+		},
+	}
+	e, err := New(`avg(q("avg:a{host=*}", "1m", "")) + -avg(q("avg:b{host=*}", "1m", ""))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, unjoinedOk := range []bool{false, true} {
+		r, _, trace, err := e.Explain(ctx, nil, nil, time.Now(), 0, unjoinedOk, search.NewSearch(), nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trace.Node != e.String() || trace.Type != "number" {
+			t.Errorf("unexpected root trace: %v %v", trace.Node, trace.Type)
+		}
+		if len(trace.Results) != len(r.Results) {
+			t.Errorf("expected %v traced results, got %v", len(r.Results), len(trace.Results))
+		}
+		if len(trace.Children) != 2 {
+			t.Fatalf("expected 2 children, got %v", len(trace.Children))
+		}
+		// avg(q(..)) and q(..)
+		if c := trace.Children[0]; len(c.Children) != 1 || len(c.Children[0].Results) != 2 {
+			t.Errorf("unexpected trace of %v: %v", c.Node, c.Children)
+		}
+		// The unary operator must not change the traced results of its argument.
+		if c := trace.Children[1].Children[0]; len(c.Results) != 1 || c.Results[0].Value != Number(100) {
+			t.Errorf("unexpected trace of %v: %v", c.Node, c.Results)
+		}
+		if len(trace.Joins) != 2 {
+			t.Fatalf("expected 2 joins, got %v", trace.Joins)
+		}
+		for _, j := range trace.Joins {
+			switch j.Group.String() {
+			case "{host=x}":
+				if j.Unjoined || !j.A.Equal(j.B) {
+					t.Errorf("unexpected join: %+v", j)
+				}
+			case "{host=y}":
+				if !j.Unjoined || j.Dropped != unjoinedOk || j.B != nil {
+					t.Errorf("unexpected join: %+v", j)
+				}
+			default:
+				t.Errorf("unexpected join: %+v", j)
+			}
+		}
+	}
+}
+
+func TestFixture(t *testing.T) {
+	f, err := fixture.Load("../fixture/testdata/cpu.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(`avg(q("avg:os.cpu{host=*}", "1h", "")) > 50`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	r, _, err := e.Execute(f, nil, nil, now, 0, false, search.NewSearch(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string]Number{"{host=ny-web01}": 0, "{host=ny-web02}": 1}
+	if len(r.Results) != len(expect) {
+		t.Fatalf("expected %v results, got %v", len(expect), len(r.Results))
+	}
+	for _, res := range r.Results {
+		if v, ok := expect[res.Group.String()]; !ok || res.Value != v {
+			t.Errorf("%v: expected %v, got %v", res.Group, v, res.Value)
+		}
+	}
+}
+
+func TestGroupFilters(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 1}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "y"}, DPS: map[string]opentsdb.Point{"0": 5}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "z"}, DPS: map[string]opentsdb.Point{"0": 3}},
+		},
+	}
+	var filterTests = []struct {
+		input  string
+		groups []string
+	}{
+		{`topk(avg(q("avg:a{host=*}", "1m", "")), 2)`, []string{"{host=y}", "{host=z}"}},
+		{`bottomk(avg(q("avg:a{host=*}", "1m", "")), 1)`, []string{"{host=x}"}},
+		{`topk(avg(q("avg:a{host=*}", "1m", "")), 5)`, []string{"{host=y}", "{host=z}", "{host=x}"}},
+		{`filter(q("avg:a{host=*}", "1m", ""), avg(q("avg:a{host=*}", "1m", "")) > 2)`, []string{"{host=y}", "{host=z}"}},
+		{`filter(avg(q("avg:a{host=*}", "1m", "")), topk(avg(q("avg:a{host=*}", "1m", "")), 1))`, []string{"{host=y}"}},
+	}
+	for _, ft := range filterTests {
+		e, err := New(ft.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(ctx, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var groups []string
+		for _, res := range r.Results {
+			groups = append(groups, res.Group.String())
+		}
+		if len(groups) != len(ft.groups) {
+			t.Errorf("%v: expected %v, got %v", ft.input, ft.groups, groups)
+			continue
+		}
+		for i, g := range ft.groups {
+			if groups[i] != g {
+				t.Errorf("%v: expected %v, got %v", ft.input, ft.groups, groups)
+				break
+			}
+		}
+	}
+}
+
+func TestAggr(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "x", "cluster": "c1"}, DPS: map[string]opentsdb.Point{"0": 1, "10": 2}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "y", "cluster": "c1"}, DPS: map[string]opentsdb.Point{"0": 3}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "z", "cluster": "c2"}, DPS: map[string]opentsdb.Point{"0": 10}},
+		},
+	}
+	var aggrTests = []struct {
+		input  string
+		output map[string]Value
+	}{
+		{`aggr(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "cluster", "sum")`, map[string]Value{"{cluster=c1}": Number(4.5), "{cluster=c2}": Number(10)}},
+		{`aggr(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "", "max")`, map[string]Value{"{}": Number(10)}},
+		{`aggr(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "cluster", "p50")`, map[string]Value{"{cluster=c1}": Number(3), "{cluster=c2}": Number(10)}},
+		{`aggr(q("avg:a{host=*,cluster=*}", "1m", ""), "cluster", "avg")`, map[string]Value{"{cluster=c1}": Series{"0": 2, "10": 2}, "{cluster=c2}": Series{"0": 10}}},
+		{`aggr(q("avg:a{host=*,cluster=*}", "1m", ""), "cluster", "count")`, map[string]Value{"{cluster=c1}": Series{"0": 2, "10": 1}, "{cluster=c2}": Series{"0": 1}}},
+		{`aggr(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "cluster", "p101")`, nil},
+	}
+	for _, at := range aggrTests {
+		e, err := New(at.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(ctx, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+		if at.output == nil {
+			if err == nil {
+				t.Errorf("%v: expected error", at.input)
+			}
+			continue
+		} else if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(r.Results) != len(at.output) {
+			t.Errorf("%v: expected %v results, got %v", at.input, len(at.output), len(r.Results))
+		}
+		for _, res := range r.Results {
+			expect, ok := at.output[res.Group.String()]
+			if !ok {
+				t.Errorf("%v: unexpected group %v", at.input, res.Group)
+			} else if fmt.Sprint(res.Value) != fmt.Sprint(expect) {
+				t.Errorf("%v: %v: expected %v, got %v", at.input, res.Group, expect, res.Value)
+			}
+		}
+	}
+}
+
+func TestPeerScores(t *testing.T) {
+	ctx := queryContext{
+		"a": {
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "w1", "cluster": "c1"}, DPS: map[string]opentsdb.Point{"0": 10}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "w2", "cluster": "c1"}, DPS: map[string]opentsdb.Point{"0": 11}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "w3", "cluster": "c1"}, DPS: map[string]opentsdb.Point{"0": 12}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "w4", "cluster": "c1"}, DPS: map[string]opentsdb.Point{"0": 40}},
+			{Metric: "a", Tags: opentsdb.TagSet{"host": "v1", "cluster": "c2"}, DPS: map[string]opentsdb.Point{"0": 5}},
+		},
+		"b": {
+			{Metric: "b", Tags: opentsdb.TagSet{"host": "w1"}, DPS: map[string]opentsdb.Point{"0": 1}},
+			{Metric: "b", Tags: opentsdb.TagSet{"host": "w2"}, DPS: map[string]opentsdb.Point{"0": 1}},
+			{Metric: "b", Tags: opentsdb.TagSet{"host": "w3"}, DPS: map[string]opentsdb.Point{"0": 5}},
+		},
+	}
+	var scoreTests = []struct {
+		input  string
+		output map[string]float64
+	}{
+		{
+			`zscore(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "cluster")`,
+			map[string]float64{
+				"{cluster=c1,host=w1}": -0.5680656107591996,
+				"{cluster=c1,host=w2}": -0.4992091730914178,
+				"{cluster=c1,host=w3}": -0.43035273542363606,
+				"{cluster=c1,host=w4}": 1.4976275192742536,
+				"{cluster=c2,host=v1}": 0,
+			},
+		},
+		{
+			`madscore(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "cluster")`,
+			map[string]float64{
+				"{cluster=c1,host=w1}": -0.6745,
+				"{cluster=c1,host=w2}": -0.33725,
+				"{cluster=c1,host=w3}": 0,
+				"{cluster=c1,host=w4}": 9.443,
+				"{cluster=c2,host=v1}": 0,
+			},
+		},
+		{
+			`madscore(avg(q("avg:a{host=*,cluster=*}", "1m", "")), "")`,
+			map[string]float64{
+				"{cluster=c1,host=w1}": -0.6745,
+				"{cluster=c1,host=w2}": 0,
+				"{cluster=c1,host=w3}": 0.6745,
+				"{cluster=c1,host=w4}": 19.5605,
+				"{cluster=c2,host=v1}": -4.047,
+			},
+		},
+		{
+			`madscore(avg(q("avg:b{host=*}", "1m", "")), "")`,
+			map[string]float64{
+				"{host=w1}": 0,
+				"{host=w2}": 0,
+				"{host=w3}": 2.3936539446619123,
+			},
+		},
+	}
+	for _, st := range scoreTests {
+		e, err := New(st.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(ctx, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if len(r.Results) != len(st.output) {
+			t.Errorf("%v: expected %v results, got %v", st.input, len(st.output), len(r.Results))
+		}
+		for _, res := range r.Results {
+			expect, ok := st.output[res.Group.String()]
+			v := float64(res.Value.(Number))
+			if !ok {
+				t.Errorf("%v: unexpected group %v", st.input, res.Group)
+			} else if v != expect && math.Abs(v-expect) > 1e-9 {
+				t.Errorf("%v: %v: expected %v, got %v", st.input, res.Group, expect, v)
+			}
+		}
+	}
+}
+
+// barrierContext answers requests only once n requests are in flight, so
+// serially issued requests never complete.
+type barrierContext struct {
+	queryContext
+	wg *sync.WaitGroup
+}
+
+func (c barrierContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	c.wg.Done()
+	c.wg.Wait()
+	return c.queryContext.Query(r)
+}
+
+func TestParallelQueries(t *testing.T) {
+	qc := queryContext{
+		"a": {{Metric: "a", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 1}}},
+		"b": {{Metric: "b", Tags: opentsdb.TagSet{"host": "x"}, DPS: map[string]opentsdb.Point{"0": 2}}},
+	}
+	var parallelTests = []struct {
+		input    string
+		requests int
+		output   Number
+		valid    bool
+	}{
+		{`avg(q("avg:a{host=x}", "1m", "")) / avg(q("avg:b{host=x}", "1m", ""))`, 2, 0.5, true},
+		{`avg(q("avg:a{host=x}", "1m", "")) + avg(band("avg:b{host=x}", "1m", "1h", 2))`, 3, 3, true},
+		{`max(q("avg:a{host=x}", "1m", "")) + avg(q("avg:a{host=x}", "1m", "")) + avg(q("avg:b{host=x}", "1m", ""))`, 3, 4, true},
+		{`avg(q("avg:a{host=x}", "1m", "")) + avg(q("avg:b{host=x}", "x", ""))`, 1, 0, false},
+	}
+	for _, pt := range parallelTests {
+		e, err := New(pt.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		wg := new(sync.WaitGroup)
+		wg.Add(pt.requests)
+		done := make(chan bool)
+		var r *Results
+		go func() {
+			r, _, err = e.Execute(barrierContext{qc, wg}, nil, nil, time.Now(), 0, false, search.NewSearch(), nil, nil)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v: queries were not issued concurrently", pt.input)
+		}
+		if err != nil {
+			if pt.valid {
+				t.Errorf("%v: %v", pt.input, err)
+			}
+			continue
+		} else if !pt.valid {
+			t.Errorf("%v: expected error", pt.input)
+			continue
+		}
+		if len(r.Results) != 1 || r.Results[0].Value != pt.output {
+			t.Errorf("%v: expected %v, got %v", pt.input, pt.output, r.Results)
+		}
+	}
+}
+
+type graphiteContext map[string]graphite.Response
+
+func (g graphiteContext) Query(r *graphite.Request) (graphite.Response, error) {
+	return g[r.Targets[0]], nil
+}
+
+func TestGraphite(t *testing.T) {
+	v := func(f float64) *float64 { return &f }
+	ctx := graphiteContext{
+		"*.cpu.*": {
+			{
+				Target:     "web01.cpu.user",
+				Datapoints: []graphite.DataPoint{{v(1), v(0)}, {nil, v(10)}, {v(3), v(20)}},
+			},
+			{
+				Target:     "web02.cpu.user",
+				Datapoints: []graphite.DataPoint{{v(5), v(0)}},
+			},
+		},
+	}
+	var graphiteTests = []struct {
+		input  string
+		output map[string]float64
+		valid  bool
+	}{
+		{`avg(graphite("*.cpu.*", "5m", "", "host.*.type"))`, map[string]float64{"{host=web01,type=user}": 2, "{host=web02,type=user}": 5}, true},
+		{`avg(graphite("*.cpu.*", "5m", "", "host.*.*"))`, map[string]float64{"{host=web01}": 2, "{host=web02}": 5}, true},
+		{`avg(graphite("*.cpu.*", "5m", "", "host.cpu"))`, nil, false},
+		{`avg(graphite("*.cpu.*", "5m", "", "*.*.type"))`, nil, false},
+	}
+	for _, gt := range graphiteTests {
+		e, err := New(gt.input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(nil, ctx, nil, time.Now(), 0, false, nil, nil, nil)
+		if err != nil {
+			if gt.valid {
+				t.Errorf("%v: %v", gt.input, err)
+			}
+			continue
+		} else if !gt.valid {
+			t.Errorf("%v: expected error", gt.input)
+			continue
+		}
+		if len(r.Results) != len(gt.output) {
+			t.Errorf("%v: expected %v results, got %v", gt.input, len(gt.output), len(r.Results))
+		}
+		for _, res := range r.Results {
+			expect, ok := gt.output[res.Group.String()]
+			if !ok {
+				t.Errorf("%v: unexpected group %v", gt.input, res.Group)
+			} else if float64(res.Value.(Number)) != expect {
+				t.Errorf("%v: %v: expected %v, got %v", gt.input, res.Group, expect, res.Value)
+			}
+		}
+	}
+}
+
+func TestStreakCrossings(t *testing.T) {
+	s := Series{"0": 1, "10": 0, "20": 2, "30": 3, "40": 5}
+	if v := streak(s); v != 3 {
+		t.Errorf("streak: expected 3, got %v", v)
+	}
+	if v := streak(Series{"0": 1, "10": 0}); v != 0 {
+		t.Errorf("streak: expected 0, got %v", v)
+	}
+	if v := crossings(s, 1); v != 1 {
+		t.Errorf("crossings: expected 1, got %v", v)
+	}
+	if v := crossings(Series{"0": 0, "10": 2, "20": 1, "30": 0, "40": 2}, 1); v != 3 {
+		t.Errorf("crossings: expected 3, got %v", v)
+	}
+	if v := crossings(s, 10); v != 0 {
+		t.Errorf("crossings: expected 0, got %v", v)
+	}
+}
+
+func TestTimeFunctions(t *testing.T) {
+	// Monday 14:30 UTC, 10:30 in New York.
+	now := time.Date(2015, 6, 1, 14, 30, 0, 0, time.UTC)
+	tests := map[string]Scalar{
+		`hour("")`:                                         14,
+		`hour("America/New_York")`:                         10,
+		`weekday("UTC")`:                                   1,
+		`businesshours("America/New_York")`:                1,
+		`businesshours("Asia/Tokyo")`:                      0,
+		`timewindow("UTC", "14:00", "14:30")`:              0,
+		`timewindow("UTC", "14:30", "15:00")`:              1,
+		`timewindow("America/New_York", "22:00", "11:00")`: 1,
+		`timewindow("UTC", "22:00", "11:00")`:              0,
+	}
+	for exprText, expected := range tests {
+		e, err := New(exprText)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r, _, err := e.Execute(nil, nil, nil, now, 0, false, search.NewSearch(), nil, nil)
+		if err != nil {
+			t.Errorf("%v: %v", exprText, err)
+			continue
+		}
+		if len(r.Results) != 1 || r.Results[0].Value != expected {
+			t.Errorf("%v: expected %v, got %v", exprText, expected, r.Results)
+		}
+	}
+	for _, exprText := range []string{`hour("Nowhere/Invalid")`, `timewindow("UTC", "9", "17:00")`} {
+		e, err := New(exprText)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if _, _, err := e.Execute(nil, nil, nil, now, 0, false, search.NewSearch(), nil, nil); err == nil {
+			t.Errorf("%v: expected error", exprText)
+		}
+	}
+}
+
+func TestPerSecond(t *testing.T) {
+	var perSecondTests = []struct {
+		counter bool
+		input   Series
+		output  Series
+	}{
+		{false, Series{"0": 10, "10": 30, "30": 20}, Series{"10": 2, "30": -0.5}},
+		{true, Series{"0": 10, "10": 30, "30": 20}, Series{"10": 2, "30": 1}},
+		{true, Series{"0": 5}, Series{}},
+	}
+	for i, pt := range perSecondTests {
+		r, err := perSecond(&Results{Results: []*Result{{Value: pt.input}}}, pt.counter)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if got := r.Results[0].Value; fmt.Sprint(got) != fmt.Sprint(pt.output) {
+			t.Errorf("%v: expected %v, got %v", i, pt.output, got)
+		}
+	}
+}
+
+func TestMovingWindow(t *testing.T) {
+	pts := Series{"0": 1, "10": 3, "20": 5, "30": 1, "60": 7}.sorted()
+	var windowTests = []struct {
+		f      func([]seriesPoint, window) Series
+		window string
+		output Series
+	}{
+		{movingavg, "2", Series{"0": 1, "10": 2, "20": 4, "30": 3, "60": 4}},
+		{movingavg, "20s", Series{"0": 1, "10": 2, "20": 4, "30": 3, "60": 7}},
+		{movingmax, "3", Series{"0": 1, "10": 3, "20": 5, "30": 5, "60": 7}},
+		{movingmax, "1m", Series{"0": 1, "10": 3, "20": 5, "30": 5, "60": 7}},
+		{ewma, "3", Series{"0": 1, "10": 2, "20": 3.5, "30": 2.25, "60": 4.625}},
+	}
+	for i, wt := range windowTests {
+		w, err := parseWindow(wt.window)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		got := wt.f(pts, w)
+		for k, v := range wt.output {
+			if got[k] != v {
+				t.Errorf("%v: %v: expected %v, got %v", i, wt.window, wt.output, got)
+				break
+			}
+		}
+	}
+	for _, w := range []string{"0", "-1", "0s", "x"} {
+		if _, err := parseWindow(w); err == nil {
+			t.Errorf("%v: expected error", w)
+		}
+	}
+}
+
+func TestHoltWinters(t *testing.T) {
+	pattern := []float64{1, 5, 3, 7}
+	dps := make(Series)
+	for i := 0; i < 13; i++ {
+		dps[strconv.Itoa(i*60)] = opentsdb.Point(pattern[i%len(pattern)] + float64(i))
+	}
+	forecast, dev := holtWinters(dps, 240)
+	if math.Abs(forecast-13) > 1e-9 {
+		t.Errorf("expected forecast 13, got %v", forecast)
+	}
+	if dev > 1e-9 {
+		t.Errorf("expected no deviation, got %v", dev)
+	}
+	dps["720"] = 20
+	if _, dev := holtWinters(dps, 240); dev > 1e-9 {
+		t.Errorf("last point should not affect deviation, got %v", dev)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("expected panic for short series")
+			}
+		}()
+		holtWinters(dps, 480)
+	}()
+}
+
 /*
 const TSDBHost = "ny-devtsdb04:4242"
 
@@ -13,6 +13,7 @@ import (
 	"github.com/bosun-monitor/bosun/_third_party/github.com/MiniProfiler/go/miniprofiler"
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
 	"github.com/bosun-monitor/bosun/expr/parse"
+	"github.com/bosun-monitor/bosun/graphite"
 )
 
 var builtins = map[string]parse.Func{
@@ -38,6 +39,11 @@ var builtins = map[string]parse.Func{
 		parse.TYPE_NUMBER,
 		Diff,
 	},
+	"graphite": {
+		[]parse.FuncType{parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_STRING},
+		parse.TYPE_SERIES,
+		GraphiteQuery,
+	},
 	"q": {
 		[]parse.FuncType{parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_STRING},
 		parse.TYPE_SERIES,
@@ -51,6 +57,11 @@ var builtins = map[string]parse.Func{
 		parse.TYPE_NUMBER,
 		Avg,
 	},
+	"crossings": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_SCALAR},
+		parse.TYPE_NUMBER,
+		Crossings,
+	},
 	"dev": {
 		[]parse.FuncType{parse.TYPE_SERIES},
 		parse.TYPE_NUMBER,
@@ -66,6 +77,16 @@ var builtins = map[string]parse.Func{
 		parse.TYPE_NUMBER,
 		Forecast_lr,
 	},
+	"hw": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_NUMBER,
+		HW,
+	},
+	"hwdev": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_NUMBER,
+		HWDev,
+	},
 	"last": {
 		[]parse.FuncType{parse.TYPE_SERIES},
 		parse.TYPE_NUMBER,
@@ -101,24 +122,115 @@ var builtins = map[string]parse.Func{
 		parse.TYPE_NUMBER,
 		Since,
 	},
+	"streak": {
+		[]parse.FuncType{parse.TYPE_SERIES},
+		parse.TYPE_NUMBER,
+		Streak,
+	},
 	"sum": {
 		[]parse.FuncType{parse.TYPE_SERIES},
 		parse.TYPE_NUMBER,
 		Sum,
 	},
 
+	// Transformation functions
+
+	"derivative": {
+		[]parse.FuncType{parse.TYPE_SERIES},
+		parse.TYPE_SERIES,
+		Derivative,
+	},
+	"ewma": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_SERIES,
+		EWMA,
+	},
+	"movingavg": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_SERIES,
+		MovingAvg,
+	},
+	"movingmax": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_SERIES,
+		MovingMax,
+	},
+	"rate": {
+		[]parse.FuncType{parse.TYPE_SERIES},
+		parse.TYPE_SERIES,
+		Rate,
+	},
+	"shift": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_SERIES,
+		Shift,
+	},
+
 	// Group functions
 
+	"aggr": {
+		[]parse.FuncType{parse.TYPE_VARIANT, parse.TYPE_STRING, parse.TYPE_STRING},
+		parse.TYPE_VARIANT,
+		Aggr,
+	},
+	"bottomk": {
+		[]parse.FuncType{parse.TYPE_NUMBER, parse.TYPE_SCALAR},
+		parse.TYPE_NUMBER,
+		BottomK,
+	},
+	"filter": {
+		[]parse.FuncType{parse.TYPE_VARIANT, parse.TYPE_NUMBER},
+		parse.TYPE_VARIANT,
+		Filter,
+	},
+	"madscore": {
+		[]parse.FuncType{parse.TYPE_NUMBER, parse.TYPE_STRING},
+		parse.TYPE_NUMBER,
+		MADScore,
+	},
 	"t": {
 		[]parse.FuncType{parse.TYPE_NUMBER, parse.TYPE_STRING},
 		parse.TYPE_SERIES,
 		Transpose,
 	},
+	"topk": {
+		[]parse.FuncType{parse.TYPE_NUMBER, parse.TYPE_SCALAR},
+		parse.TYPE_NUMBER,
+		TopK,
+	},
 	"ungroup": {
 		[]parse.FuncType{parse.TYPE_NUMBER},
 		parse.TYPE_SCALAR,
 		Ungroup,
 	},
+	"zscore": {
+		[]parse.FuncType{parse.TYPE_NUMBER, parse.TYPE_STRING},
+		parse.TYPE_NUMBER,
+		ZScore,
+	},
+
+	// Time functions
+
+	"businesshours": {
+		[]parse.FuncType{parse.TYPE_STRING},
+		parse.TYPE_SCALAR,
+		BusinessHours,
+	},
+	"hour": {
+		[]parse.FuncType{parse.TYPE_STRING},
+		parse.TYPE_SCALAR,
+		Hour,
+	},
+	"timewindow": {
+		[]parse.FuncType{parse.TYPE_STRING, parse.TYPE_STRING, parse.TYPE_STRING},
+		parse.TYPE_SCALAR,
+		TimeWindow,
+	},
+	"weekday": {
+		[]parse.FuncType{parse.TYPE_STRING},
+		parse.TYPE_SCALAR,
+		Weekday,
+	},
 
 	// Other functions
 
@@ -127,6 +239,11 @@ var builtins = map[string]parse.Func{
 		parse.TYPE_NUMBER,
 		Abs,
 	},
+	"align": {
+		[]parse.FuncType{parse.TYPE_SERIES, parse.TYPE_STRING},
+		parse.TYPE_SERIES,
+		Align,
+	},
 	"dropna": {
 		[]parse.FuncType{parse.TYPE_SERIES},
 		parse.TYPE_SERIES,
@@ -149,6 +266,17 @@ func NV(e *state, T miniprofiler.Timer, series *Results, v float64) (results *Re
 	return series, nil
 }
 
+// Align sets the timestamp alignment used when series is combined with another
+// series by a binary operator.
+func Align(e *state, T miniprofiler.Timer, series *Results, align string) (*Results, error) {
+	a, err := ParseAlignment(align)
+	if err != nil {
+		return nil, err
+	}
+	series.Align = a
+	return series, nil
+}
+
 func DropNA(e *state, T miniprofiler.Timer, series *Results) (*Results, error) {
 	for _, res := range series.Results {
 		nv := make(Series)
@@ -222,8 +350,10 @@ func Band(e *state, T miniprofiler.Timer, query, duration, period string, num fl
 		}
 		if num < 1 || num > 100 {
 			err = fmt.Errorf("expr: Band: num out of bounds")
+			return
 		}
-		q, err := opentsdb.ParseQuery(query)
+		var q *opentsdb.Query
+		q, err = opentsdb.ParseQuery(query)
 		if q == nil && err != nil {
 			return
 		}
@@ -239,13 +369,24 @@ func Band(e *state, T miniprofiler.Timer, query, duration, period string, num fl
 		if err = req.SetTime(e.now); err != nil {
 			return
 		}
-		for i := 0; i < int(num); i++ {
+		// Fetch all windows concurrently, then merge them in order so later
+		// windows take precedence as before.
+		windows := make([]opentsdb.ResponseSet, int(num))
+		errs := make([]error, int(num))
+		fns := make([]func(), int(num))
+		for i := range fns {
 			now = now.Add(time.Duration(-p))
-			req.End = now.Unix()
-			req.Start = now.Add(time.Duration(-d)).Unix()
-			var s opentsdb.ResponseSet
-			s, err = timeRequest(e, T, &req)
-			if err != nil {
+			wreq := req
+			wreq.End = now.Unix()
+			wreq.Start = now.Add(time.Duration(-d)).Unix()
+			i := i
+			fns[i] = func() {
+				windows[i], errs[i] = timeRequest(e, T, &wreq)
+			}
+		}
+		parallel(fns...)
+		for i, s := range windows {
+			if err = errs[i]; err != nil {
 				return
 			}
 			for _, res := range s {
@@ -325,6 +466,13 @@ func Query(e *state, T miniprofiler.Timer, query, sduration, eduration string) (
 
 func timeRequest(e *state, T miniprofiler.Timer, req *opentsdb.Request) (s opentsdb.ResponseSet, err error) {
 	r := *req
+	// Copy the queries since AutoDownsample modifies them and req may be
+	// shared with concurrent requests.
+	r.Queries = make([]*opentsdb.Query, len(req.Queries))
+	for i, q := range req.Queries {
+		nq := *q
+		r.Queries[i] = &nq
+	}
 	if e.autods > 0 {
 		if err := r.AutoDownsample(e.autods); err != nil {
 			return nil, err
@@ -338,6 +486,90 @@ func timeRequest(e *state, T miniprofiler.Timer, req *opentsdb.Request) (s opent
 	return
 }
 
+// GraphiteQuery queries the Graphite render API for target over the relative
+// range sduration to eduration. format maps the dot-separated nodes of each
+// returned series name to tag keys: "host.*.cpu" tags "web01.os.cpu0" as
+// {host=web01,cpu=cpu0}. Nodes whose format entry is "*" or empty are ignored.
+func GraphiteQuery(e *state, T miniprofiler.Timer, target, sduration, eduration, format string) (r *Results, err error) {
+	r = new(Results)
+	sd, err := opentsdb.ParseDuration(sduration)
+	if err != nil {
+		return
+	}
+	var ed opentsdb.Duration
+	if eduration != "" {
+		ed, err = opentsdb.ParseDuration(eduration)
+		if err != nil {
+			return
+		}
+	}
+	st := e.now.Add(-time.Duration(sd))
+	et := e.now.Add(-time.Duration(ed))
+	req := &graphite.Request{
+		Targets: []string{target},
+		Start:   &st,
+		End:     &et,
+	}
+	var s graphite.Response
+	T.StepCustomTiming("graphite", "query", req.String(), func() {
+		s, err = e.graphite.Query(req)
+	})
+	if err != nil {
+		return
+	}
+	formatTags := strings.Split(format, ".")
+	for _, res := range s {
+		var tags opentsdb.TagSet
+		tags, err = graphiteTags(res.Target, formatTags)
+		if err != nil {
+			return
+		}
+		if e.squelched(tags) {
+			continue
+		}
+		for _, a := range r.Results {
+			if a.Group.Equal(tags) {
+				return nil, fmt.Errorf("graphite: duplicate group %s from target %s", tags, res.Target)
+			}
+		}
+		dps := make(Series)
+		for _, dp := range res.Datapoints {
+			if dp[0] == nil || dp[1] == nil {
+				continue
+			}
+			dps[strconv.FormatInt(int64(*dp[1]), 10)] = opentsdb.Point(*dp[0])
+		}
+		r.Results = append(r.Results, &Result{
+			Value: dps,
+			Group: tags,
+		})
+	}
+	return
+}
+
+// graphiteTags returns the tags for the series named name according to the
+// node format.
+func graphiteTags(name string, format []string) (opentsdb.TagSet, error) {
+	tags := make(opentsdb.TagSet)
+	if len(format) == 1 && format[0] == "" {
+		return tags, nil
+	}
+	nodes := strings.Split(name, ".")
+	if len(nodes) != len(format) {
+		return nil, fmt.Errorf("graphite: series %s has %d nodes, format expects %d", name, len(nodes), len(format))
+	}
+	for i, key := range format {
+		if key == "" || key == "*" {
+			continue
+		}
+		if !opentsdb.ValidTag(nodes[i]) {
+			return nil, fmt.Errorf("graphite: invalid tag value %q for %s in series %s", nodes[i], key, name)
+		}
+		tags[key] = nodes[i]
+	}
+	return tags, nil
+}
+
 func Change(e *state, T miniprofiler.Timer, query, sduration, eduration string) (r *Results, err error) {
 	r = new(Results)
 	sd, err := opentsdb.ParseDuration(sduration)
@@ -520,6 +752,50 @@ func since(dps Series, args ...float64) (a float64) {
 	return s.Seconds()
 }
 
+func Streak(e *state, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return reduce(e, T, series, streak)
+}
+
+// streak returns the number of consecutive non-zero points at the end of the
+// series. NaN points end a streak.
+func streak(dps Series, args ...float64) (a float64) {
+	pts := dps.sorted()
+	for i := len(pts) - 1; i >= 0; i-- {
+		if v := pts[i].V; v == 0 || math.IsNaN(v) {
+			break
+		}
+		a++
+	}
+	return
+}
+
+func Crossings(e *state, T miniprofiler.Timer, series *Results, x float64) (*Results, error) {
+	return reduce(e, T, series, crossings, x)
+}
+
+// crossings returns the number of times the series crosses args[0]. Points
+// equal to args[0], and NaN points, do not change the side of the series.
+func crossings(dps Series, args ...float64) (a float64) {
+	x := args[0]
+	var side int
+	for _, p := range dps.sorted() {
+		var s int
+		switch {
+		case p.V > x:
+			s = 1
+		case p.V < x:
+			s = -1
+		default:
+			continue
+		}
+		if side != 0 && s != side {
+			a++
+		}
+		side = s
+	}
+	return
+}
+
 func Forecast_lr(e *state, T miniprofiler.Timer, series *Results, y float64) (r *Results, err error) {
 	return reduce(e, T, series, forecast_lr, y)
 }
@@ -561,6 +837,115 @@ func forecast_lr(dps Series, args ...float64) float64 {
 	return s.Seconds()
 }
 
+// Smoothing factors for the level, trend and seasonal components of the
+// Holt-Winters model.
+const (
+	hwAlpha = 0.3
+	hwBeta  = 0.05
+	hwGamma = 0.3
+)
+
+func HW(e *state, T miniprofiler.Timer, series *Results, season string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(season)
+	if err != nil {
+		return nil, err
+	}
+	return reduce(e, T, series, hwForecast, d.Seconds())
+}
+
+func HWDev(e *state, T miniprofiler.Timer, series *Results, season string) (*Results, error) {
+	d, err := opentsdb.ParseDuration(season)
+	if err != nil {
+		return nil, err
+	}
+	return reduce(e, T, series, hwDev, d.Seconds())
+}
+
+// hwForecast returns the value the Holt-Winters model predicts for the most
+// recent point of dps, given the points before it.
+func hwForecast(dps Series, args ...float64) float64 {
+	f, _ := holtWinters(dps, args[0])
+	return f
+}
+
+// hwDev returns the standard deviation of the one-step-ahead errors of the
+// Holt-Winters model over all points of dps except the most recent.
+func hwDev(dps Series, args ...float64) float64 {
+	_, d := holtWinters(dps, args[0])
+	return d
+}
+
+// holtWinters fits an additive Holt-Winters model with a season of the given
+// number of seconds to dps. The series is resampled at its median point
+// interval and must span at least two seasons. It returns the forecast for the
+// last point and the standard deviation of the forecast errors before it.
+func holtWinters(dps Series, season float64) (forecast, dev float64) {
+	pts := dps.sorted()
+	if len(pts) < 2 {
+		panic(fmt.Errorf("hw: series requires at least two points"))
+	}
+	steps := make([]float64, len(pts)-1)
+	for i := range steps {
+		steps[i] = float64(pts[i+1].T - pts[i].T)
+	}
+	sort.Float64s(steps)
+	step := steps[len(steps)/2]
+	m := int(math.Floor(season/step + .5))
+	if m < 2 {
+		panic(fmt.Errorf("hw: season must span at least two points"))
+	}
+	x := resample(pts, int64(step))
+	n := len(x)
+	if n < 2*m+1 {
+		panic(fmt.Errorf("hw: series must span at least two seasons"))
+	}
+	var level, trend float64
+	for i := 0; i < m; i++ {
+		level += x[i]
+		trend += x[m+i] - x[i]
+	}
+	level /= float64(m)
+	trend /= float64(m * m)
+	// level is the mean of the first season, centered in it. Move it to the
+	// last point of the season and take the seasonal components relative to
+	// the trend line.
+	mid := float64(m-1) / 2
+	seasonal := make([]float64, n)
+	for i := 0; i < m; i++ {
+		seasonal[i] = x[i] - (level + trend*(float64(i)-mid))
+	}
+	level += trend * mid
+	var sq float64
+	for t := m; t < n; t++ {
+		forecast = level + trend + seasonal[t-m]
+		if t == n-1 {
+			break
+		}
+		sq += math.Pow(x[t]-forecast, 2)
+		last := level
+		level = hwAlpha*(x[t]-seasonal[t-m]) + (1-hwAlpha)*(level+trend)
+		trend = hwBeta*(level-last) + (1-hwBeta)*trend
+		seasonal[t] = hwGamma*(x[t]-level) + (1-hwGamma)*seasonal[t-m]
+	}
+	dev = math.Sqrt(sq / float64(n-1-m))
+	return
+}
+
+// resample returns the values of pts at every step seconds from the first to
+// the last point, linearly interpolating between points.
+func resample(pts []seriesPoint, step int64) []float64 {
+	var x []float64
+	i := 0
+	for t := pts[0].T; t <= pts[len(pts)-1].T; t += step {
+		for pts[i+1].T < t {
+			i++
+		}
+		l, r := pts[i], pts[i+1]
+		x = append(x, l.V+(r.V-l.V)*float64(t-l.T)/float64(r.T-l.T))
+	}
+	return x
+}
+
 func Percentile(e *state, T miniprofiler.Timer, series *Results, p float64) (r *Results, err error) {
 	return reduce(e, T, series, percentile, p)
 }
@@ -597,6 +982,174 @@ func percentile(dps Series, args ...float64) (a float64) {
 	return x[int(i)]
 }
 
+// window is a moving window over a sorted series, sized either by a number of
+// points or by a duration in seconds.
+type window struct {
+	points int
+	secs   int64
+}
+
+// parseWindow parses w as either a point count ("10") or an OpenTSDB duration
+// ("5m").
+func parseWindow(w string) (win window, err error) {
+	if n, err := strconv.Atoi(w); err == nil {
+		if n < 1 {
+			return win, fmt.Errorf("expr: window must be at least 1 point")
+		}
+		win.points = n
+		return win, nil
+	}
+	d, err := opentsdb.ParseDuration(w)
+	if err != nil {
+		return win, err
+	}
+	win.secs = int64(d.Seconds())
+	if win.secs < 1 {
+		return win, fmt.Errorf("expr: window must be at least 1s")
+	}
+	return win, nil
+}
+
+// start returns the index of the first point of the window ending at pts[i].
+func (w window) start(pts []seriesPoint, i int) int {
+	if w.points > 0 {
+		if j := i - w.points + 1; j > 0 {
+			return j
+		}
+		return 0
+	}
+	j := i
+	for j > 0 && pts[i].T-pts[j-1].T < w.secs {
+		j--
+	}
+	return j
+}
+
+func movingWindow(e *state, T miniprofiler.Timer, series *Results, w string, F func([]seriesPoint, window) Series) (*Results, error) {
+	win, err := parseWindow(w)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series.Results {
+		switch t := s.Value.(type) {
+		case Series:
+			s.Value = F(t.sorted(), win)
+		default:
+			panic(fmt.Errorf("expr: expected a series"))
+		}
+	}
+	return series, nil
+}
+
+func MovingAvg(e *state, T miniprofiler.Timer, series *Results, w string) (*Results, error) {
+	return movingWindow(e, T, series, w, movingavg)
+}
+
+// movingavg returns the mean of each window of pts.
+func movingavg(pts []seriesPoint, w window) Series {
+	s := make(Series)
+	for i, p := range pts {
+		var sum float64
+		j := w.start(pts, i)
+		for _, q := range pts[j : i+1] {
+			sum += q.V
+		}
+		s[strconv.FormatInt(p.T, 10)] = opentsdb.Point(sum / float64(i-j+1))
+	}
+	return s
+}
+
+func MovingMax(e *state, T miniprofiler.Timer, series *Results, w string) (*Results, error) {
+	return movingWindow(e, T, series, w, movingmax)
+}
+
+// movingmax returns the maximum of each window of pts.
+func movingmax(pts []seriesPoint, w window) Series {
+	s := make(Series)
+	for i, p := range pts {
+		m := math.Inf(-1)
+		for _, q := range pts[w.start(pts, i) : i+1] {
+			m = math.Max(m, q.V)
+		}
+		s[strconv.FormatInt(p.T, 10)] = opentsdb.Point(m)
+	}
+	return s
+}
+
+func EWMA(e *state, T miniprofiler.Timer, series *Results, w string) (*Results, error) {
+	return movingWindow(e, T, series, w, ewma)
+}
+
+// ewma returns the exponentially weighted moving average of pts. For a window
+// of N points the smoothing factor is 2/(N+1). For a duration window the
+// weight of each point decays with its age in units of the duration, so
+// irregularly spaced points are handled.
+func ewma(pts []seriesPoint, w window) Series {
+	s := make(Series)
+	var avg float64
+	for i, p := range pts {
+		if i == 0 {
+			avg = p.V
+		} else {
+			alpha := 2 / (float64(w.points) + 1)
+			if w.points == 0 {
+				alpha = 1 - math.Exp(-float64(p.T-pts[i-1].T)/float64(w.secs))
+			}
+			avg += alpha * (p.V - avg)
+		}
+		s[strconv.FormatInt(p.T, 10)] = opentsdb.Point(avg)
+	}
+	return s
+}
+
+// Derivative returns the per-second change between consecutive points of each
+// series. The first point has no predecessor and is dropped.
+func Derivative(e *state, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return perSecond(series, false)
+}
+
+// Rate returns the per-second rate of increase of each counter series. A
+// decrease is treated as a counter reset to zero, so the rate after a reset is
+// the new value divided by the elapsed time. The first point is dropped.
+func Rate(e *state, T miniprofiler.Timer, series *Results) (*Results, error) {
+	return perSecond(series, true)
+}
+
+func perSecond(series *Results, counter bool) (*Results, error) {
+	for _, res := range series.Results {
+		pts := res.Value.(Series).sorted()
+		s := make(Series)
+		for i := 1; i < len(pts); i++ {
+			p, prev := pts[i], pts[i-1]
+			delta := p.V - prev.V
+			if counter && delta < 0 {
+				delta = p.V
+			}
+			s[strconv.FormatInt(p.T, 10)] = opentsdb.Point(delta / float64(p.T-prev.T))
+		}
+		res.Value = s
+	}
+	return series, nil
+}
+
+// Shift moves every point of each series later by duration d, so a series
+// from a past window can be compared with the current one.
+func Shift(e *state, T miniprofiler.Timer, series *Results, d string) (*Results, error) {
+	od, err := opentsdb.ParseDuration(d)
+	if err != nil {
+		return nil, err
+	}
+	secs := int64(od.Seconds())
+	for _, res := range series.Results {
+		s := make(Series)
+		for _, p := range res.Value.(Series).sorted() {
+			s[strconv.FormatInt(p.T+secs, 10)] = opentsdb.Point(p.V)
+		}
+		res.Value = s
+	}
+	return series, nil
+}
+
 func Ungroup(e *state, T miniprofiler.Timer, d *Results) (*Results, error) {
 	if len(d.Results) != 1 {
 		return nil, fmt.Errorf("ungroup: requires exactly one group")
@@ -639,3 +1192,353 @@ func Transpose(e *state, T miniprofiler.Timer, d *Results, gp string) (*Results,
 	}
 	return &r, nil
 }
+
+// TopK keeps the k groups of d with the largest values.
+func TopK(e *state, T miniprofiler.Timer, d *Results, k float64) (*Results, error) {
+	return rank(d, k, func(a, b float64) bool { return a > b })
+}
+
+// BottomK keeps the k groups of d with the smallest values.
+func BottomK(e *state, T miniprofiler.Timer, d *Results, k float64) (*Results, error) {
+	return rank(d, k, func(a, b float64) bool { return a < b })
+}
+
+// rank sorts d by less and keeps the first k results. NaN values sort last.
+func rank(d *Results, k float64, less func(a, b float64) bool) (*Results, error) {
+	if k < 0 || k != math.Floor(k) {
+		return nil, fmt.Errorf("expr: k must be a non-negative integer, got %v", k)
+	}
+	sort.Stable(byValue{d.Results, less})
+	if int(k) < len(d.Results) {
+		d.Results = d.Results[:int(k)]
+	}
+	return d, nil
+}
+
+type byValue struct {
+	r    []*Result
+	less func(a, b float64) bool
+}
+
+func (b byValue) Len() int      { return len(b.r) }
+func (b byValue) Swap(i, j int) { b.r[i], b.r[j] = b.r[j], b.r[i] }
+func (b byValue) Less(i, j int) bool {
+	x, y := float64(b.r[i].Value.(Number)), float64(b.r[j].Value.(Number))
+	if math.IsNaN(x) || math.IsNaN(y) {
+		return !math.IsNaN(x)
+	}
+	return b.less(x, y)
+}
+
+// Filter keeps the groups of d whose condition is non-zero. A group's
+// condition is the cond result with the same group or a subset of it; groups
+// with no condition, or a NaN condition, are dropped.
+func Filter(e *state, T miniprofiler.Timer, d *Results, cond *Results) (*Results, error) {
+	var results []*Result
+	for _, r := range d.Results {
+		for _, c := range cond.Results {
+			if !r.Group.Subset(c.Group) {
+				continue
+			}
+			if v := float64(c.Value.(Number)); v == 0 || math.IsNaN(v) {
+				continue
+			}
+			r.Computations = append(r.Computations, c.Computations...)
+			results = append(results, r)
+			break
+		}
+	}
+	d.Results = results
+	return d, nil
+}
+
+// parseAggregator returns the reduction function and its arguments for the
+// named aggregator: sum, avg, min, max, median, dev, count, or pNN for the
+// NNth percentile (p95, p99.9).
+func parseAggregator(name string) (func(Series, ...float64) float64, []float64, error) {
+	switch name {
+	case "sum":
+		return sum, nil, nil
+	case "avg":
+		return avg, nil, nil
+	case "min":
+		return percentile, []float64{0}, nil
+	case "max":
+		return percentile, []float64{1}, nil
+	case "median":
+		return percentile, []float64{.5}, nil
+	case "dev":
+		return dev, nil, nil
+	case "count":
+		return length, nil, nil
+	}
+	if strings.HasPrefix(name, "p") {
+		p, err := strconv.ParseFloat(name[1:], 64)
+		if err == nil && p >= 0 && p <= 100 {
+			return percentile, []float64{p / 100}, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("expr: unknown aggregator %q", name)
+}
+
+// Aggr combines the groups of d that share the same values for the
+// comma-separated tag keys gp into a single group, using aggregator. Numbers are
+// aggregated directly; series are aggregated per timestamp across the points
+// present in each group. An empty gp aggregates all groups into one.
+func Aggr(e *state, T miniprofiler.Timer, d *Results, gp string, aggregator string) (*Results, error) {
+	F, args, err := parseAggregator(aggregator)
+	if err != nil {
+		return nil, err
+	}
+	gps := tagKeys(gp)
+	type aggGroup struct {
+		*Result
+		values map[string]Series
+	}
+	var groups []*aggGroup
+	m := make(map[string]*aggGroup)
+	number := false
+	for _, r := range d.Results {
+		ts := subGroup(r.Group, gps)
+		g := m[ts.String()]
+		if g == nil {
+			g = &aggGroup{
+				Result: &Result{Group: ts},
+				values: make(map[string]Series),
+			}
+			m[ts.String()] = g
+			groups = append(groups, g)
+		}
+		add := func(k string, v opentsdb.Point) {
+			s := g.values[k]
+			if s == nil {
+				s = make(Series)
+				g.values[k] = s
+			}
+			s[strconv.Itoa(len(s))] = v
+		}
+		switch v := r.Value.(type) {
+		case Number:
+			number = true
+			add("", opentsdb.Point(v))
+			g.Computations = append(g.Computations, r.Computations...)
+		case Series:
+			for k, p := range v {
+				add(k, p)
+			}
+		default:
+			return nil, fmt.Errorf("expr: aggr: expected a number or series")
+		}
+	}
+	results := &Results{
+		IgnoreUnjoined:      d.IgnoreUnjoined,
+		IgnoreOtherUnjoined: d.IgnoreOtherUnjoined,
+		NaNValue:            d.NaNValue,
+		Align:               d.Align,
+	}
+	for _, g := range groups {
+		if number {
+			g.Value = Number(F(g.values[""], args...))
+		} else {
+			s := make(Series)
+			for k, vs := range g.values {
+				s[k] = opentsdb.Point(F(vs, args...))
+			}
+			g.Value = s
+		}
+		results.Results = append(results.Results, g.Result)
+	}
+	return results, nil
+}
+
+// tagKeys splits the comma-separated tag keys in s.
+func tagKeys(s string) []string {
+	var keys []string
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// subGroup returns the tags of g with the given keys.
+func subGroup(g opentsdb.TagSet, keys []string) opentsdb.TagSet {
+	ts := make(opentsdb.TagSet)
+	for _, k := range keys {
+		if v, ok := g[k]; ok {
+			ts[k] = v
+		}
+	}
+	return ts
+}
+
+// ZScore scores each group of d by the number of standard deviations its value
+// is from the mean of its peers: the groups sharing its values for the
+// comma-separated tag keys gp. An empty gp makes all groups peers. If all peers
+// are equal, each scores 0.
+func ZScore(e *state, T miniprofiler.Timer, d *Results, gp string) (*Results, error) {
+	return peerScore(d, gp, func(peers Series) func(float64) float64 {
+		m, sd := avg(peers), dev(peers)
+		return func(v float64) float64 {
+			if sd == 0 {
+				return 0
+			}
+			return (v - m) / sd
+		}
+	})
+}
+
+// MADScore scores each group of d by its modified z-score among its peers, as
+// in ZScore: 0.6745 * (v - median) / MAD, where MAD is the median absolute
+// deviation of the peers from their median. Unlike ZScore, the score is not
+// skewed by the outliers themselves. If the MAD is 0, the score is instead
+// (v - median) / (1.253314 * meanAD), where meanAD is the mean absolute
+// deviation from the median. If all peers are equal, each scores 0.
+func MADScore(e *state, T miniprofiler.Timer, d *Results, gp string) (*Results, error) {
+	return peerScore(d, gp, func(peers Series) func(float64) float64 {
+		med := percentile(peers, .5)
+		devs := make(Series, len(peers))
+		for k, v := range peers {
+			devs[k] = opentsdb.Point(math.Abs(float64(v) - med))
+		}
+		mad, meanAD := percentile(devs, .5), avg(devs)
+		return func(v float64) float64 {
+			switch {
+			case mad != 0:
+				return 0.6745 * (v - med) / mad
+			case meanAD != 0:
+				return (v - med) / (1.253314 * meanAD)
+			}
+			return 0
+		}
+	})
+}
+
+// peerScore partitions the groups of d into peers by the tag keys gp, and
+// replaces each value by its score. score is called once per set of peers with
+// their values and returns the scoring function for that set. NaN values are
+// not peers of any group and score NaN.
+func peerScore(d *Results, gp string, score func(peers Series) func(float64) float64) (*Results, error) {
+	keys := tagKeys(gp)
+	peers := make(map[string]Series)
+	for _, r := range d.Results {
+		v := float64(r.Value.(Number))
+		if math.IsNaN(v) {
+			continue
+		}
+		k := subGroup(r.Group, keys).String()
+		s := peers[k]
+		if s == nil {
+			s = make(Series)
+			peers[k] = s
+		}
+		s[strconv.Itoa(len(s))] = opentsdb.Point(v)
+	}
+	scores := make(map[string]func(float64) float64)
+	for k, s := range peers {
+		scores[k] = score(s)
+	}
+	results := &Results{
+		IgnoreUnjoined:      d.IgnoreUnjoined,
+		IgnoreOtherUnjoined: d.IgnoreOtherUnjoined,
+		NaNValue:            d.NaNValue,
+	}
+	for _, r := range d.Results {
+		v := float64(r.Value.(Number))
+		if !math.IsNaN(v) {
+			v = scores[subGroup(r.Group, keys).String()](v)
+		}
+		results.Results = append(results.Results, &Result{
+			Group:        r.Group,
+			Computations: r.Computations,
+			Value:        Number(v),
+		})
+	}
+	return results, nil
+}
+
+// localNow returns the evaluation time in the named time zone. An empty name
+// is UTC.
+func localNow(e *state, tz string) (time.Time, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return e.now.In(loc), nil
+}
+
+// Hour returns the hour of the day, 0 through 23, in time zone tz.
+func Hour(e *state, T miniprofiler.Timer, tz string) (*Results, error) {
+	t, err := localNow(e, tz)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(float64(t.Hour())), nil
+}
+
+// Weekday returns the day of the week in time zone tz: 0 for Sunday through 6
+// for Saturday.
+func Weekday(e *state, T miniprofiler.Timer, tz string) (*Results, error) {
+	t, err := localNow(e, tz)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(float64(t.Weekday())), nil
+}
+
+// BusinessHours returns 1 from 09:00 to 17:00, Monday through Friday, in time
+// zone tz, and 0 otherwise.
+func BusinessHours(e *state, T miniprofiler.Timer, tz string) (*Results, error) {
+	t, err := localNow(e, tz)
+	if err != nil {
+		return nil, err
+	}
+	if wd := t.Weekday(); wd == time.Saturday || wd == time.Sunday {
+		return wrap(0), nil
+	}
+	return wrap(inWindow(t, 9*time.Hour, 17*time.Hour)), nil
+}
+
+// TimeWindow returns 1 if the time of day in time zone tz is within [start,
+// end), and 0 otherwise. start and end are of the form 15:04. A window whose
+// end is before its start spans midnight.
+func TimeWindow(e *state, T miniprofiler.Timer, tz, start, end string) (*Results, error) {
+	t, err := localNow(e, tz)
+	if err != nil {
+		return nil, err
+	}
+	s, err := parseClock(start)
+	if err != nil {
+		return nil, err
+	}
+	f, err := parseClock(end)
+	if err != nil {
+		return nil, err
+	}
+	return wrap(inWindow(t, s, f)), nil
+}
+
+// parseClock parses a time of day of the form 15:04 as an offset from
+// midnight.
+func parseClock(s string) (time.Duration, error) {
+	c, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("expr: bad time of day %q, expected HH:MM", s)
+	}
+	return time.Duration(c.Hour())*time.Hour + time.Duration(c.Minute())*time.Minute, nil
+}
+
+func inWindow(t time.Time, start, end time.Duration) float64 {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	var in bool
+	if start <= end {
+		in = d >= start && d < end
+	} else {
+		in = d >= start || d < end
+	}
+	if in {
+		return 1
+	}
+	return 0
+}
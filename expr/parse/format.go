@@ -0,0 +1,158 @@
+package parse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Operator precedence, loosest first. A node is parenthesized when it appears
+// where the grammar expects a tighter binding than its own.
+const (
+	precLet = iota
+	precTernary
+	precOr
+	precAnd
+	precCompare
+	precAdd
+	precMult
+	precUnary
+	precPrimary
+)
+
+// tabWidth is the width of an indent when measuring lines against the format
+// width.
+const tabWidth = 4
+
+// Format returns the canonical text of n: operators are separated by single
+// spaces, function arguments by ", ", and parentheses are only used where
+// precedence requires them. Nodes whose text would extend a line beyond width
+// columns are broken over several lines and indented with tabs. If width is
+// less than or equal to zero, the result is a single line.
+func Format(n Node, width int) string {
+	p := &printer{width: width}
+	return p.print(n, 0)
+}
+
+type printer struct {
+	width int
+	// parens holds nodes that are parenthesized even where precedence does
+	// not require it.
+	parens map[Node]bool
+}
+
+// flat returns a printer like p that does not break lines.
+func (p *printer) flat() *printer {
+	return &printer{parens: p.parens}
+}
+
+// print returns the text of n, assuming it starts a line indented by indent
+// tabs.
+func (p *printer) print(n Node, indent int) string {
+	flat := p.flat().broken(n, indent)
+	if p.width <= 0 || indent*tabWidth+len(flat) <= p.width {
+		return flat
+	}
+	return p.broken(n, indent)
+}
+
+// broken returns the text of n, broken over lines if p has a width.
+func (p *printer) broken(n Node, indent int) string {
+	nl := " "
+	if p.width > 0 {
+		nl = "\n" + strings.Repeat("\t", indent+1)
+	}
+	switch n := n.(type) {
+	case *FuncNode:
+		if len(n.Args) == 0 {
+			return n.Name + "()"
+		}
+		args := make([]string, len(n.Args))
+		for i, a := range n.Args {
+			args[i] = p.operand(a, precTernary, indent+1)
+		}
+		if p.width <= 0 {
+			return n.Name + "(" + strings.Join(args, ", ") + ")"
+		}
+		return n.Name + "(" + nl + strings.Join(args, ","+nl) + "\n" + strings.Repeat("\t", indent) + ")"
+	case *BinaryNode:
+		prec := precedence(n)
+		// Binary operators are left associative, so a right operand of
+		// equal precedence needs parentheses.
+		left := p.operand(n.Args[0], prec, indent)
+		right := p.flat().operand(n.Args[1], prec+1, indent+1)
+		// Keep a short right operand on the last line of a left operand
+		// that was already broken.
+		if i := strings.LastIndex(left, "\n"); i >= 0 && p.width > 0 && len(left)-i-1+len(n.OpStr)+len(right)+2 <= p.width-indent*tabWidth {
+			return left + " " + n.OpStr + " " + right
+		}
+		return left + " " + n.OpStr + nl + p.operand(n.Args[1], prec+1, indent+1)
+	case *UnaryNode:
+		// Adjacent operators would lex as one symbol, so a unary operand
+		// of a unary operator is always parenthesized.
+		prec := precUnary
+		if _, ok := n.Arg.(*UnaryNode); ok {
+			prec = precPrimary
+		}
+		return n.OpStr + p.operand(n.Arg, prec, indent)
+	case *TernaryNode:
+		return p.operand(n.Args[0], precOr, indent) + " ?" + nl +
+			p.operand(n.Args[1], precTernary, indent+1) + " :" + nl +
+			p.operand(n.Args[2], precTernary, indent+1)
+	case *LetNode:
+		sep := " "
+		if p.width > 0 {
+			sep = "\n" + strings.Repeat("\t", indent)
+		}
+		return "let " + n.Name + " = " + p.operand(n.Value, precTernary, indent) + ";" + sep + p.print(n.Body, indent)
+	case *NumberNode, *StringNode, *VarNode:
+		return n.String()
+	default:
+		panic(fmt.Errorf("other type: %T", n))
+	}
+}
+
+// operand returns the text of n where the grammar requires at least precedence
+// prec, adding parentheses if needed.
+func (p *printer) operand(n Node, prec, indent int) string {
+	if precedence(n) >= prec && !p.parens[n] {
+		return p.print(n, indent)
+	}
+	return "(" + p.print(n, indent) + ")"
+}
+
+func precedence(n Node) int {
+	switch n := n.(type) {
+	case *LetNode:
+		return precLet
+	case *TernaryNode:
+		return precTernary
+	case *BinaryNode:
+		switch n.Operator.typ {
+		case itemOr:
+			return precOr
+		case itemAnd:
+			return precAnd
+		case itemEq, itemNotEq, itemGreater, itemGreaterEq, itemLess, itemLessEq:
+			return precCompare
+		case itemPlus, itemMinus:
+			return precAdd
+		default:
+			return precMult
+		}
+	case *UnaryNode:
+		return precUnary
+	default:
+		return precPrimary
+	}
+}
+
+// Format returns the canonical text of t. See Format. If simplify is false,
+// parentheses written around an operand in the parsed text are kept even where
+// precedence does not require them.
+func (t *Tree) Format(width int, simplify bool) string {
+	p := &printer{width: width}
+	if !simplify {
+		p.parens = t.parens
+	}
+	return p.print(t.Root, 0)
+}
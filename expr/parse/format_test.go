@@ -0,0 +1,80 @@
+package parse
+
+import "testing"
+
+var formatTests = []struct {
+	input  string
+	width  int
+	result string
+}{
+	{`1+2*3`, 0, `1 + 2 * 3`},
+	{`(1+2)*3`, 0, `(1 + 2) * 3`},
+	{`((1))-(2-3)`, 0, `1 - (2 - 3)`},
+	{`(1-2)-3`, 0, `1 - 2 - 3`},
+	{`!(1&&2)||(1||2)`, 0, `!(1 && 2) || (1 || 2)`},
+	{`(1||2)||3`, 0, `1 || 2 || 3`},
+	{`-(-1)`, 0, `-(-1)`},
+	{`2* -1`, 0, `2 * -1`},
+	{`(1?2:3)?(4):(5?6:7)`, 0, `(1 ? 2 : 3) ? 4 : 5 ? 6 : 7`},
+	{`avg(q("q","1m"))>(let x=1;x)`, 0, `avg(q("q", "1m")) > (let x = 1; x)`},
+	{`let x=(let y=1;y);avg(1?q("q","1m"):q("q","2m"))*x`, 0, `let x = (let y = 1; y); avg(1 ? q("q", "1m") : q("q", "2m")) * x`},
+	{`avg(q("q","1m"))>1`, 80, `avg(q("q", "1m")) > 1`},
+	{`avg(q("sum:os.cpu{host=*}", "5m"))>80 && forecastlr(q("sum:os.cpu{host=*}", "5m"), 100)<1`, 40,
+		"avg(q(\"sum:os.cpu{host=*}\", \"5m\")) > 80 &&\n" +
+			"\tforecastlr(\n" +
+			"\t\tq(\"sum:os.cpu{host=*}\", \"5m\"),\n" +
+			"\t\t100\n" +
+			"\t) < 1"},
+	{`let x=q("sum:os.cpu{host=*}","5m");avg(x)>80?1:0`, 30,
+		"let x = q(\"sum:os.cpu{host=*}\", \"5m\");\n" +
+			"avg(x) > 80 ? 1 : 0"},
+}
+
+func TestFormat(t *testing.T) {
+	for _, test := range formatTests {
+		tree, err := Parse(test.input, builtins)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		result := tree.Format(test.width, true)
+		if result != test.result {
+			t.Errorf("%s: got\n%v\nexpected\n%v", test.input, result, test.result)
+			continue
+		}
+		// The formatted text must parse to the same tree.
+		again, err := Parse(result, builtins)
+		if err != nil {
+			t.Errorf("%s: reparse: %v", test.input, err)
+			continue
+		}
+		if a, b := tree.Root.StringAST(), again.Root.StringAST(); a != b {
+			t.Errorf("%s: reparsed as %s, expected %s", test.input, b, a)
+		}
+	}
+}
+
+var keepParensTests = []struct {
+	input  string
+	result string
+}{
+	{`(1+2)*3`, `(1 + 2) * 3`},
+	{`((1))-(2-3)`, `(1) - (2 - 3)`},
+	{`(1-2)-3`, `(1 - 2) - 3`},
+	{`(1||2)||(3)`, `(1 || 2) || (3)`},
+	{`avg((q("q","1m")))`, `avg((q("q", "1m")))`},
+	{`(1)`, `1`},
+}
+
+func TestFormatKeepParens(t *testing.T) {
+	for _, test := range keepParensTests {
+		tree, err := Parse(test.input, builtins)
+		if err != nil {
+			t.Errorf("%s: %v", test.input, err)
+			continue
+		}
+		if result := tree.Format(0, false); result != test.result {
+			t.Errorf("%s: got\n%v\nexpected\n%v", test.input, result, test.result)
+		}
+	}
+}
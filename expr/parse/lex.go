@@ -49,6 +49,11 @@ const (
 	itemMinus     // '-'
 	itemMult      // '*'
 	itemDiv       // '/'
+	itemQuestion  // '?'
+	itemColon     // ':'
+	itemAssign    // '='
+	itemSemicolon // ';'
+	itemLet       // 'let' keyword
 	itemNumber    // simple number
 	itemComma
 	itemLeftParen
@@ -183,6 +188,12 @@ Loop:
 			return lexString
 		case r == ',':
 			l.emit(itemComma)
+		case r == '?':
+			l.emit(itemQuestion)
+		case r == ':':
+			l.emit(itemColon)
+		case r == ';':
+			l.emit(itemSemicolon)
 		case isSpace(r):
 			l.ignore()
 		case r == eof:
@@ -256,6 +267,8 @@ func lexSymbol(l *lexer) stateFn {
 		l.emit(itemMult)
 	case "/":
 		l.emit(itemDiv)
+	case "=":
+		l.emit(itemAssign)
 	default:
 		l.emit(itemError)
 	}
@@ -269,7 +282,11 @@ func lexFunc(l *lexer) stateFn {
 			// absorb
 		default:
 			l.backup()
-			l.emit(itemFunc)
+			if l.input[l.start:l.pos] == "let" {
+				l.emit(itemLet)
+			} else {
+				l.emit(itemFunc)
+			}
 			return lexItem
 		}
 	}
@@ -26,6 +26,11 @@ var itemName = map[itemType]string{
 	itemMinus:      "-",
 	itemMult:       "*",
 	itemDiv:        "/",
+	itemQuestion:   "?",
+	itemColon:      ":",
+	itemAssign:     "=",
+	itemSemicolon:  ";",
+	itemLet:        "let",
 	itemNumber:     "number",
 	itemComma:      ",",
 	itemLeftParen:  "(",
@@ -66,6 +71,8 @@ var (
 	tMinus = item{itemMinus, 0, "-"}
 	tMult  = item{itemMult, 0, "*"}
 	tDiv   = item{itemDiv, 0, "/"}
+	tQues  = item{itemQuestion, 0, "?"}
+	tColon = item{itemColon, 0, ":"}
 )
 
 var lexTests = []lexTest{
@@ -123,6 +130,26 @@ var lexTests = []lexTest{
 		{itemNumber, 0, "0.4"},
 		tEOF,
 	}},
+	{"conditional", "1>2?-1:2", []item{
+		{itemNumber, 0, "1"},
+		tGt,
+		{itemNumber, 0, "2"},
+		tQues,
+		tMinus,
+		{itemNumber, 0, "1"},
+		tColon,
+		{itemNumber, 0, "2"},
+		tEOF,
+	}},
+	{"let", "let x=1; x", []item{
+		{itemLet, 0, "let"},
+		{itemFunc, 0, "x"},
+		{itemAssign, 0, "="},
+		{itemNumber, 0, "1"},
+		{itemSemicolon, 0, ";"},
+		{itemFunc, 0, "x"},
+		tEOF,
+	}},
 	// errors
 	{"unclosed quote", "\"", []item{
 		{itemError, 0, "unterminated string"},
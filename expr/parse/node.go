@@ -50,11 +50,14 @@ func (t NodeType) Type() NodeType {
 }
 
 const (
-	NodeFunc   NodeType = iota // A function call.
-	NodeBinary                 // Binary operator: math, logical, compare
-	NodeUnary                  // Unary operator: !, -
-	NodeString                 // A string constant.
-	NodeNumber                 // A numerical constant.
+	NodeFunc    NodeType = iota // A function call.
+	NodeBinary                  // Binary operator: math, logical, compare
+	NodeUnary                   // Unary operator: !, -
+	NodeString                  // A string constant.
+	NodeNumber                  // A numerical constant.
+	NodeTernary                 // Conditional operator: cond ? a : b
+	NodeLet                     // A let binding.
+	NodeVar                     // A reference to a let binding.
 )
 
 // Nodes.
@@ -82,7 +85,7 @@ func (c *FuncNode) String() string {
 		if i > 0 {
 			s += ", "
 		}
-		s += arg.String()
+		s += operandString(arg, precTernary)
 	}
 	s += ")"
 	return s
@@ -110,7 +113,11 @@ func (c *FuncNode) Check() error {
 	for i, a := range c.Args {
 		t := c.F.Args[i]
 		at := a.Return()
-		if t != at {
+		if t == TYPE_VARIANT {
+			if at != TYPE_NUMBER && at != TYPE_SERIES {
+				return fmt.Errorf("parse: expected number or series, got %v", at)
+			}
+		} else if t != at {
 			return fmt.Errorf("parse: expected %v, got %v", t, at)
 		}
 		if err := a.Check(); err != nil {
@@ -120,7 +127,17 @@ func (c *FuncNode) Check() error {
 	return nil
 }
 
-func (f *FuncNode) Return() FuncType { return f.F.Return }
+func (f *FuncNode) Return() FuncType {
+	if f.F.Return != TYPE_VARIANT {
+		return f.F.Return
+	}
+	for i, t := range f.F.Args {
+		if t == TYPE_VARIANT && i < len(f.Args) {
+			return f.Args[i].Return()
+		}
+	}
+	return TYPE_VARIANT
+}
 
 // NumberNode holds a number: signed or unsigned integer or float.
 // The value is parsed and stored under all the types that can represent the value.
@@ -219,7 +236,8 @@ func newBinary(operator item, arg1, arg2 Node) *BinaryNode {
 }
 
 func (b *BinaryNode) String() string {
-	return fmt.Sprintf("%s %s %s", b.Args[0], b.Operator.val, b.Args[1])
+	prec := precedence(b)
+	return fmt.Sprintf("%s %s %s", operandString(b.Args[0], prec), b.Operator.val, operandString(b.Args[1], prec+1))
 }
 
 func (b *BinaryNode) StringAST() string {
@@ -229,15 +247,13 @@ func (b *BinaryNode) StringAST() string {
 func (b *BinaryNode) Check() error {
 	t1 := b.Args[0].Return()
 	t2 := b.Args[1].Return()
-	if t1 == TYPE_SERIES && t2 == TYPE_SERIES {
-		return fmt.Errorf("parse: type error in %s: at least one side must be a number", b)
-	}
-	check := t1
-	if t1 == TYPE_SERIES {
-		check = t2
-	}
-	if check != TYPE_NUMBER && check != TYPE_SCALAR {
-		return fmt.Errorf("parse: type error in %s: expected a number", b)
+	for _, t := range []FuncType{t1, t2} {
+		switch t {
+		case TYPE_NUMBER, TYPE_SCALAR, TYPE_SERIES:
+			// ok
+		default:
+			return fmt.Errorf("parse: type error in %s: expected a number or series", b)
+		}
 	}
 	if err := b.Args[0].Check(); err != nil {
 		return err
@@ -254,6 +270,131 @@ func (b *BinaryNode) Return() FuncType {
 	return t0
 }
 
+// TernaryNode holds a condition and the two values it selects between.
+type TernaryNode struct {
+	NodeType
+	Pos
+	Args [3]Node // condition, value if true, value if false
+}
+
+func newTernary(pos Pos, cond, a, b Node) *TernaryNode {
+	return &TernaryNode{NodeType: NodeTernary, Pos: pos, Args: [3]Node{cond, a, b}}
+}
+
+func (t *TernaryNode) String() string {
+	return fmt.Sprintf("%s ? %s : %s", operandString(t.Args[0], precOr), operandString(t.Args[1], precTernary), operandString(t.Args[2], precTernary))
+}
+
+func (t *TernaryNode) StringAST() string {
+	return fmt.Sprintf("?:(%s, %s, %s)", t.Args[0], t.Args[1], t.Args[2])
+}
+
+func (t *TernaryNode) Check() error {
+	switch c := t.Args[0].Return(); c {
+	case TYPE_NUMBER, TYPE_SCALAR:
+		// ok
+	default:
+		return fmt.Errorf("parse: type error in %s: expected a number condition, got %s", t, c)
+	}
+	a, b := t.Args[1].Return(), t.Args[2].Return()
+	for _, v := range []FuncType{a, b} {
+		switch v {
+		case TYPE_NUMBER, TYPE_SCALAR, TYPE_SERIES:
+			// ok
+		default:
+			return fmt.Errorf("parse: type error in %s: expected a number or series", t)
+		}
+	}
+	if (a == TYPE_SERIES) != (b == TYPE_SERIES) {
+		return fmt.Errorf("parse: type error in %s: both values must be numbers or both series", t)
+	}
+	for _, n := range t.Args {
+		if err := n.Check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TernaryNode) Return() FuncType {
+	a, b := t.Args[1].Return(), t.Args[2].Return()
+	if b > a {
+		return b
+	}
+	return a
+}
+
+// LetNode binds the value of an expression to a name within its body.
+type LetNode struct {
+	NodeType
+	Pos
+	Name  string
+	Value Node
+	Body  Node
+}
+
+func newLet(pos Pos, name string, value Node) *LetNode {
+	return &LetNode{NodeType: NodeLet, Pos: pos, Name: name, Value: value}
+}
+
+func (l *LetNode) String() string {
+	return fmt.Sprintf("let %s = %s; %s", l.Name, operandString(l.Value, precTernary), l.Body)
+}
+
+func (l *LetNode) StringAST() string {
+	return fmt.Sprintf("let(%s, %s, %s)", l.Name, l.Value.StringAST(), l.Body.StringAST())
+}
+
+func (l *LetNode) Check() error {
+	switch t := l.Value.Return(); t {
+	case TYPE_NUMBER, TYPE_SCALAR, TYPE_SERIES:
+		// ok
+	default:
+		return fmt.Errorf("parse: type error in let %s: expected a number or series, got %s", l.Name, t)
+	}
+	if err := l.Value.Check(); err != nil {
+		return err
+	}
+	return l.Body.Check()
+}
+
+func (l *LetNode) Return() FuncType { return l.Body.Return() }
+
+// operandString returns the text of n as an operand of another node where the
+// grammar requires at least precedence prec, parenthesized if n binds more
+// loosely. See Format.
+func operandString(n Node, prec int) string {
+	if precedence(n) < prec {
+		return "(" + n.String() + ")"
+	}
+	return n.String()
+}
+
+// VarNode is a reference to the value of a let binding.
+type VarNode struct {
+	NodeType
+	Pos
+	Let *LetNode
+}
+
+func newVar(pos Pos, l *LetNode) *VarNode {
+	return &VarNode{NodeType: NodeVar, Pos: pos, Let: l}
+}
+
+func (v *VarNode) String() string {
+	return v.Let.Name
+}
+
+func (v *VarNode) StringAST() string {
+	return v.String()
+}
+
+func (v *VarNode) Check() error {
+	return nil
+}
+
+func (v *VarNode) Return() FuncType { return v.Let.Value.Return() }
+
 // UnaryNode holds one argument and an operator.
 type UnaryNode struct {
 	NodeType
@@ -268,7 +409,11 @@ func newUnary(operator item, arg Node) *UnaryNode {
 }
 
 func (u *UnaryNode) String() string {
-	return fmt.Sprintf("%s%s", u.Operator.val, u.Arg)
+	prec := precUnary
+	if _, ok := u.Arg.(*UnaryNode); ok {
+		prec = precPrimary
+	}
+	return fmt.Sprintf("%s%s", u.Operator.val, operandString(u.Arg, prec))
 }
 
 func (u *UnaryNode) StringAST() string {
@@ -299,10 +444,17 @@ func Walk(n Node, f func(Node)) {
 		for _, a := range n.Args {
 			Walk(a, f)
 		}
-	case *NumberNode, *StringNode:
+	case *LetNode:
+		Walk(n.Value, f)
+		Walk(n.Body, f)
+	case *NumberNode, *StringNode, *VarNode:
 		// Ignore.
 	case *UnaryNode:
 		Walk(n.Arg, f)
+	case *TernaryNode:
+		for _, a := range n.Args {
+			Walk(a, f)
+		}
 	default:
 		panic(fmt.Errorf("other type: %T", n))
 	}
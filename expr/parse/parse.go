@@ -17,11 +17,14 @@ import (
 type Tree struct {
 	Text string // text parsed to create the expression.
 	Root Node   // top-level root of the tree, returns a number.
+	// parens holds the nodes written in parentheses.
+	parens map[Node]bool
 	// Parsing only; cleared after parse.
 	funcs     []map[string]Func
 	lex       *lexer
-	token     [1]item // one-token lookahead for parser.
+	token     [2]item // two-token lookahead for parser.
 	peekCount int
+	lets      []*LetNode // enclosing let bindings, innermost last.
 }
 
 type Func struct {
@@ -42,6 +45,8 @@ func (f FuncType) String() string {
 		return "series"
 	case TYPE_SCALAR:
 		return "scalar"
+	case TYPE_VARIANT:
+		return "variant"
 	default:
 		return "unknown"
 	}
@@ -52,6 +57,9 @@ const (
 	TYPE_SCALAR
 	TYPE_NUMBER
 	TYPE_SERIES
+	// TYPE_VARIANT accepts a number or series argument. A function returning
+	// TYPE_VARIANT returns the type of its first variant argument.
+	TYPE_VARIANT
 )
 
 // Parse returns a Tree, created by parsing the expression described in the
@@ -79,6 +87,13 @@ func (t *Tree) backup() {
 	t.peekCount++
 }
 
+// backup2 backs the input stream up two tokens.
+// The zeroth token is already there.
+func (t *Tree) backup2(t1 item) {
+	t.token[1] = t1
+	t.peekCount = 2
+}
+
 // peek returns but does not consume the next token.
 func (t *Tree) peek() item {
 	if t.peekCount > 0 {
@@ -151,6 +166,7 @@ func (t *Tree) recover(errp *error) {
 // startParse initializes the parser, using the lexer.
 func (t *Tree) startParse(funcs []map[string]Func, lex *lexer) {
 	t.Root = nil
+	t.parens = nil
 	t.lex = lex
 	t.funcs = funcs
 }
@@ -159,6 +175,7 @@ func (t *Tree) startParse(funcs []map[string]Func, lex *lexer) {
 func (t *Tree) stopParse() {
 	t.lex = nil
 	t.funcs = nil
+	t.lets = nil
 }
 
 // Parse parses the template definition string to construct a representation of
@@ -177,7 +194,7 @@ func (t *Tree) Parse(text string, funcs ...map[string]Func) (err error) {
 // parse is the top-level parser for a template.
 // It runs to EOF.
 func (t *Tree) parse() {
-	t.Root = t.O()
+	t.Root = t.L()
 	t.expect(itemEOF, "input")
 	if err := t.Root.Check(); err != nil {
 		t.error(err)
@@ -185,18 +202,46 @@ func (t *Tree) parse() {
 }
 
 /* Grammar:
+L -> "let" name "=" E ";" L | E
+E -> O ["?" E ":" E]
 O -> A {"||" A}
 A -> C {"&&" C}
 C -> P {( "==" | "!=" | ">" | ">=" | "<" | "<=") P}
 P -> M {( "+" | "-" ) M}
 M -> F {( "*" | "/" ) F}
-F -> v | "(" O ")" | "!" O | "-" O
-v -> number | func(..)
+F -> v | "(" L ")" | "!" O | "-" O
+v -> number | func(..) | name
 Func -> name "(" param {"," param} ")"
 param -> number | "string" | [query]
 */
 
 // expr:
+func (t *Tree) L() Node {
+	if t.peek().typ != itemLet {
+		return t.E()
+	}
+	token := t.next()
+	name := t.expect(itemFunc, "let")
+	t.expect(itemAssign, "let")
+	l := newLet(token.pos, name.val, t.E())
+	t.expect(itemSemicolon, "let")
+	t.lets = append(t.lets, l)
+	l.Body = t.L()
+	t.lets = t.lets[:len(t.lets)-1]
+	return l
+}
+
+func (t *Tree) E() Node {
+	n := t.O()
+	if t.peek().typ != itemQuestion {
+		return n
+	}
+	token := t.next()
+	a := t.E()
+	t.expect(itemColon, "conditional")
+	return newTernary(token.pos, n, a, t.E())
+}
+
 func (t *Tree) O() Node {
 	n := t.A()
 	for {
@@ -265,8 +310,12 @@ func (t *Tree) F() Node {
 		return newUnary(t.next(), t.F())
 	case itemLeftParen:
 		t.next()
-		n := t.O()
+		n := t.L()
 		t.expect(itemRightParen, "input")
+		if t.parens == nil {
+			t.parens = make(map[Node]bool)
+		}
+		t.parens[n] = true
 		return n
 	default:
 		t.unexpected(token, "input")
@@ -283,7 +332,10 @@ func (t *Tree) v() Node {
 		}
 		return n
 	case itemFunc:
-		t.backup()
+		if t.peek().typ != itemLeftParen {
+			return t.variable(token)
+		}
+		t.backup2(token)
 		return t.Func()
 	default:
 		t.unexpected(token, "input")
@@ -291,6 +343,17 @@ func (t *Tree) v() Node {
 	return nil
 }
 
+// variable returns a reference to the innermost let binding named by token.
+func (t *Tree) variable(token item) Node {
+	for i := len(t.lets) - 1; i >= 0; i-- {
+		if l := t.lets[i]; l.Name == token.val {
+			return newVar(token.pos, l)
+		}
+	}
+	t.errorf("undefined variable %s", token.val)
+	return nil
+}
+
 func (t *Tree) Func() (f *FuncNode) {
 	token := t.next()
 	funcv, ok := t.getFunction(token.val)
@@ -303,7 +366,7 @@ func (t *Tree) Func() (f *FuncNode) {
 		switch token = t.next(); token.typ {
 		default:
 			t.backup()
-			f.append(t.O())
+			f.append(t.E())
 		case itemString:
 			s, err := strconv.Unquote(token.val)
 			if err != nil {
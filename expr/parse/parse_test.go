@@ -107,6 +107,19 @@ var parseTests = []parseTest{
 	{"unary series", `!q("q", "1m")`, noError, `!q("q", "1m")`},
 	{"expr in func", `forecastlr(q("q", "1m"), -1)`, noError, `forecastlr(q("q", "1m"), -1)`},
 	{"nested func expr", `avg(q("q","1m")>0)`, noError, `avg(q("q", "1m") > 0)`},
+	{"series math", `q("q", "1m")/q("q", "1m")`, noError, `q("q", "1m") / q("q", "1m")`},
+	{"conditional", `avg(q("q", "1m"))>1?1:0`, noError, `avg(q("q", "1m")) > 1 ? 1 : 0`},
+	{"nested conditional", `1?2:3?4:5`, noError, `1 ? 2 : 3 ? 4 : 5`},
+	{"let", `let x = q("q", "1m"); avg(x)+forecastlr(x, 1)`, noError, `let x = q("q", "1m"); avg(x) + forecastlr(x, 1)`},
+	{"nested let", `let x = 1; (let y = x*2; y) + x`, noError, `let x = 1; (let y = x * 2; y) + x`},
+	{"let in let", `let x = 1; let y = x; y`, noError, `let x = 1; let y = x; y`},
+	{"variant series", `avg(filter(q("q", "1m"), avg(q("q", "1m"))))`, noError, `avg(filter(q("q", "1m"), avg(q("q", "1m"))))`},
+	{"variant number", `filter(avg(q("q", "1m")), 1 > avg(q("q", "1m"))) > 0`, noError, `filter(avg(q("q", "1m")), 1 > avg(q("q", "1m"))) > 0`},
+	{"conditional in func", `avg(1 ? q("q", "1m") : q("q", "2m"))`, noError, `avg(1 ? q("q", "1m") : q("q", "2m"))`},
+	{"conditional operand", `1 + (1 ? 2 : 3)`, noError, `1 + (1 ? 2 : 3)`},
+	{"conditional left operand", `(1 ? 2 : 3) * 4`, noError, `(1 ? 2 : 3) * 4`},
+	{"grouped operands", `(1 + 2) * -(3 - 4) - (5 - 6)`, noError, `(1 + 2) * -(3 - 4) - (5 - 6)`},
+	{"conditional in condition", `(1 ? 2 : 3) ? 4 : 5`, noError, `(1 ? 2 : 3) ? 4 : 5`},
 	// Errors.
 	{"empty", "", hasError, ""},
 	{"unclosed function", "avg(", hasError, ""},
@@ -114,6 +127,15 @@ var parseTests = []parseTest{
 	{"bad type", `band("q", "1h", "1m", "8")`, hasError, ""},
 	{"wrong number args", `avg(q("q", "1m"), "1m", 1)`, hasError, ""},
 	{"2 series math", `band(q("q", "1m"))+band(q("q", "1m"))`, hasError, ""},
+	{"missing colon", `1 ? 2`, hasError, ""},
+	{"variant string", `filter("q", avg(q("q", "1m")))`, hasError, ""},
+	{"variant return", `avg(filter(avg(q("q", "1m")), avg(q("q", "1m"))))`, hasError, ""},
+	{"undefined variable", `let x = 1; y`, hasError, ""},
+	{"variable out of scope", `(let x = 1; x) + x`, hasError, ""},
+	{"let string", `let x = "q"; x`, hasError, ""},
+	{"let missing semicolon", `let x = 1 x`, hasError, ""},
+	{"series condition", `q("q", "1m") ? 1 : 0`, hasError, ""},
+	{"mixed conditional", `1 ? q("q", "1m") : 0`, hasError, ""},
 }
 
 func TestParse(t *testing.T) {
@@ -144,6 +166,32 @@ func TestParse(t *testing.T) {
 	}
 }
 
+func TestStringRoundTrip(t *testing.T) {
+	tests := []string{
+		`1 + (1 ? 2 : 3)`,
+		`(1 ? 2 : 3) * 4`,
+		`-(1 ? 2 : 3) + 4 > 5 ? 6 : 7`,
+		`1 ? 2 + (3 ? 4 : 5) : (6 ? 7 : 8) - 9`,
+		`(1 || 2) && (3 ? 4 : 5) == 6`,
+		`avg(q("q", "1m")) / (avg(q("q", "1m")) > 1 ? 2 : 3)`,
+	}
+	for _, input := range tests {
+		a := New(nil)
+		if err := a.Parse(input, builtins); err != nil {
+			t.Errorf("%s: %v", input, err)
+			continue
+		}
+		b := New(nil)
+		if err := b.Parse(a.Root.String(), builtins); err != nil {
+			t.Errorf("%s: reparse %s: %v", input, a.Root, err)
+			continue
+		}
+		if a.Root.StringAST() != b.Root.StringAST() {
+			t.Errorf("%s: printed as %s, which parses as\n\t%s\nexpected\n\t%s", input, a.Root, b.Root.StringAST(), a.Root.StringAST())
+		}
+	}
+}
+
 var builtins = map[string]Func{
 	"avg": {
 		[]FuncType{TYPE_SERIES},
@@ -165,4 +213,9 @@ var builtins = map[string]Func{
 		TYPE_NUMBER,
 		nil,
 	},
+	"filter": {
+		[]FuncType{TYPE_VARIANT, TYPE_NUMBER},
+		TYPE_VARIANT,
+		nil,
+	},
 }
@@ -0,0 +1,95 @@
+package expr
+
+import (
+	"time"
+
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+	"github.com/bosun-monitor/bosun/expr/parse"
+)
+
+// Trace records the evaluation of one node of an expression. The inputs of a
+// node are the results of its children.
+type Trace struct {
+	Node     string
+	Type     string
+	Duration time.Duration
+	Results  []*Result
+	// Joins lists how the groups of the operands of a binary or conditional
+	// operator were matched.
+	Joins    []Join   `json:",omitempty"`
+	Children []*Trace `json:",omitempty"`
+}
+
+// Join records how one group of a binary or conditional operator was formed.
+type Join struct {
+	Group opentsdb.TagSet
+	// A and B are the groups of the joined operands. For an unjoined group,
+	// the operand without a match is nil.
+	A, B opentsdb.TagSet
+	// Unjoined is true if the group had no match in the other operand.
+	Unjoined bool `json:",omitempty"`
+	// Dropped is true if an unjoined group was left out of the result.
+	Dropped bool `json:",omitempty"`
+}
+
+// trace returns the trace of node, creating it if needed. e must be locked.
+func (e *state) trace(node parse.Node) *Trace {
+	t := e.traces[node]
+	if t == nil {
+		t = &Trace{
+			Node: node.String(),
+			Type: node.Return().String(),
+		}
+		e.traces[node] = t
+	}
+	return t
+}
+
+func (e *state) traceJoin(node parse.Node, j Join) {
+	if e.traces == nil {
+		return
+	}
+	e.Lock()
+	t := e.trace(node)
+	t.Joins = append(t.Joins, j)
+	e.Unlock()
+}
+
+// traceResults records the results of node. They are copied since callers may
+// modify them.
+func (e *state) traceResults(node parse.Node, res *Results, d time.Duration) {
+	e.Lock()
+	t := e.trace(node)
+	t.Results = res.copy().Results
+	t.Duration = d
+	e.Unlock()
+}
+
+// buildTrace links the trace of node to the traces of its evaluated children
+// and returns it. The value of a let binding is a child of the let node, not of
+// the variables that refer to it.
+func (e *state) buildTrace(node parse.Node) *Trace {
+	t := e.traces[node]
+	if t == nil {
+		return nil
+	}
+	var children []parse.Node
+	switch n := node.(type) {
+	case *parse.BinaryNode:
+		children = n.Args[:]
+	case *parse.UnaryNode:
+		children = []parse.Node{n.Arg}
+	case *parse.FuncNode:
+		children = n.Args
+	case *parse.TernaryNode:
+		children = n.Args[:]
+	case *parse.LetNode:
+		children = []parse.Node{n.Value, n.Body}
+	}
+	for _, c := range children {
+		if ct := e.buildTrace(c); ct != nil {
+			t.Children = append(t.Children, ct)
+		}
+	}
+	return t
+}
@@ -0,0 +1,59 @@
+package fixture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+)
+
+type staticContext opentsdb.ResponseSet
+
+func (c staticContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	return opentsdb.ResponseSet(c), nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "fixture.json")
+	q, err := opentsdb.ParseQuery("avg:m{host=*}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &opentsdb.Request{
+		Start:   "2015/01/01-10:00:00",
+		End:     "2015/01/01-11:00:00",
+		Queries: []*opentsdb.Query{q},
+	}
+	rec := Record(staticContext{
+		{Metric: "m", Tags: opentsdb.TagSet{"host": "a"}, DPS: map[string]opentsdb.Point{"1420106400": 1.5}},
+	})
+	if _, err := rec.Query(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := rec.Save(filename); err != nil {
+		t.Fatal(err)
+	}
+	f, err := Load(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := f.Query(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rs) != 1 || rs[0].Tags["host"] != "a" || rs[0].DPS["1420106400"] != 1.5 {
+		t.Errorf("unexpected response: %v", rs)
+	}
+	other := *req
+	other.End = "2015/01/01-12:00:00"
+	if _, err := f.Query(&other); err == nil {
+		t.Error("expected error for unrecorded request")
+	}
+}
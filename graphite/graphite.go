@@ -0,0 +1,162 @@
+// Package graphite queries the Graphite render API.
+package graphite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Request is a render API request for one or more targets.
+type Request struct {
+	Targets []string
+	Start   *time.Time
+	End     *time.Time
+}
+
+// Series is a single series returned by the render API.
+type Series struct {
+	Datapoints []DataPoint `json:"datapoints"`
+	Target     string      `json:"target"`
+}
+
+// DataPoint is a value and unix timestamp pair. The value is nil if Graphite
+// has no data for the timestamp.
+type DataPoint [2]*float64
+
+type Response []Series
+
+// Values returns the url parameters of r, excluding the format.
+func (r *Request) Values() url.Values {
+	v := make(url.Values)
+	for _, t := range r.Targets {
+		v.Add("target", t)
+	}
+	if r.Start != nil {
+		v.Add("from", strconv.FormatInt(r.Start.Unix(), 10))
+	}
+	if r.End != nil {
+		v.Add("until", strconv.FormatInt(r.End.Unix(), 10))
+	}
+	return v
+}
+
+func (r *Request) String() string {
+	return r.Values().Encode()
+}
+
+// DefaultClient is the default http client for requests.
+var DefaultClient = &http.Client{
+	Timeout: time.Minute,
+}
+
+// QueryResponse performs a render API request to the given host. host should
+// be of the form hostname:port. A nil client uses DefaultClient.
+func (r *Request) QueryResponse(host string, client *http.Client) (*http.Response, error) {
+	v := r.Values()
+	v.Set("format", "json")
+	u := url.URL{
+		Scheme:   "http",
+		Host:     host,
+		Path:     "/render",
+		RawQuery: v.Encode(),
+	}
+	if client == nil {
+		client = DefaultClient
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("graphite: %s: %s", resp.Status, body)
+	}
+	return resp, nil
+}
+
+// Query performs a render API request to the given host. Uses DefaultClient.
+func (r *Request) Query(host string) (Response, error) {
+	resp, err := r.QueryResponse(host, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var s Response
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+type Context interface {
+	Query(*Request) (Response, error)
+}
+
+type Host string
+
+func (h Host) Query(r *Request) (Response, error) {
+	return r.Query(string(h))
+}
+
+// Cache is a Context that remembers the result of each distinct request. It is
+// safe for concurrent use; concurrent identical requests are only sent once.
+type Cache struct {
+	Host string
+	// Limit limits response size in bytes
+	Limit int64
+	cache map[string]*cacheResult
+	lock  sync.Mutex
+}
+
+type cacheResult struct {
+	Response
+	Err   error
+	ready chan bool
+}
+
+func NewCache(host string, limit int64) *Cache {
+	return &Cache{
+		Host:  host,
+		Limit: limit,
+		cache: make(map[string]*cacheResult),
+	}
+}
+
+func (c *Cache) Query(r *Request) (res Response, err error) {
+	s := r.String()
+	c.lock.Lock()
+	if v, ok := c.cache[s]; ok {
+		c.lock.Unlock()
+		<-v.ready
+		return v.Response, v.Err
+	}
+	v := &cacheResult{ready: make(chan bool)}
+	c.cache[s] = v
+	c.lock.Unlock()
+	defer func() {
+		v.Response, v.Err = res, err
+		close(v.ready)
+	}()
+	if c.Host == "" {
+		return nil, fmt.Errorf("graphite: no host configured")
+	}
+	resp, err := r.QueryResponse(c.Host, nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	lr := &io.LimitedReader{R: resp.Body, N: c.Limit}
+	err = json.NewDecoder(lr).Decode(&res)
+	if lr.N == 0 {
+		err = fmt.Errorf("graphite response too large: limited to %E bytes", float64(c.Limit))
+	}
+	return
+}
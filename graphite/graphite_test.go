@@ -0,0 +1,69 @@
+package graphite
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	var got url.Values
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/render" {
+			http.NotFound(w, r)
+			return
+		}
+		got = r.URL.Query()
+		fmt.Fprint(w, `[{"target": "web01.cpu", "datapoints": [[1.5, 60], [null, 120], [3, 180]]}]`)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	st, et := time.Unix(60, 0), time.Unix(180, 0)
+	req := &Request{
+		Targets: []string{"*.cpu"},
+		Start:   &st,
+		End:     &et,
+	}
+	c := NewCache(u.Host, 1<<20)
+	resp, err := c.Query(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Get("target") != "*.cpu" || got.Get("from") != "60" || got.Get("until") != "180" || got.Get("format") != "json" {
+		t.Errorf("unexpected request parameters: %v", got)
+	}
+	if len(resp) != 1 || resp[0].Target != "web01.cpu" {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	dps := resp[0].Datapoints
+	if len(dps) != 3 {
+		t.Fatalf("expected 3 datapoints, got %v", len(dps))
+	}
+	if *dps[0][0] != 1.5 || *dps[0][1] != 60 {
+		t.Errorf("unexpected datapoint: %v, %v", *dps[0][0], *dps[0][1])
+	}
+	if dps[1][0] != nil {
+		t.Errorf("expected nil value, got %v", *dps[1][0])
+	}
+	got = nil
+	if _, err := c.Query(req); err != nil {
+		t.Fatal(err)
+	}
+	if got != nil {
+		t.Error("expected cached response")
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad target", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	if _, err := Host(u.Host).Query(&Request{Targets: []string{"("}}); err == nil {
+		t.Error("expected error")
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -11,10 +12,12 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/collect"
@@ -27,6 +30,7 @@ import (
 var (
 	flagConf     = flag.String("c", "dev.conf", "config file location")
 	flagTest     = flag.Bool("t", false, "test for valid config; exits with 0 on success, else 1")
+	flagFmt      = flag.Bool("fmt", false, "print the config file in canonical form and exit")
 	flagWatch    = flag.Bool("w", false, "watch .go files below current directory and exit; also build typescript files on change")
 	flagReadonly = flag.Bool("r", false, "readonly-mode: don't write or relay any OpenTSDB metrics")
 	flagQuiet    = flag.Bool("q", false, "quiet-mode: don't send any notifications except from the rule test page")
@@ -35,6 +39,18 @@ var (
 func main() {
 	flag.Parse()
 	runtime.GOMAXPROCS(runtime.NumCPU())
+	if *flagFmt {
+		b, err := ioutil.ReadFile(*flagConf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s, err := conf.Format(*flagConf, string(b))
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.WriteString(s)
+		os.Exit(0)
+	}
 	c, err := conf.ParseFile(*flagConf)
 	if err != nil {
 		log.Fatal(err)
@@ -84,8 +100,30 @@ func main() {
 	if *flagQuiet {
 		c.Quiet = true
 	}
-	go func() { log.Fatal(web.Listen(c.HttpListen, c.WebDir, tsdbHost)) }()
+	reload := func() error {
+		nc, err := conf.ParseFile(*flagConf)
+		if err != nil {
+			return err
+		}
+		if *flagReadonly {
+			nc.TsdbHost = c.TsdbHost
+		}
+		if *flagQuiet {
+			nc.Quiet = true
+		}
+		return sched.DefaultSched.Reload(nc)
+	}
+	go func() { log.Fatal(web.Listen(c.HttpListen, c.WebDir, tsdbHost, reload)) }()
 	go func() { log.Fatal(sched.Run()) }()
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for _ = range hup {
+			if err := reload(); err != nil {
+				log.Println("reload failed:", err)
+			}
+		}
+	}()
 	if *flagWatch {
 		watch(".", "*.go", quit)
 		watch(filepath.Join("web", "templates"), "*.html", quit)
@@ -5,13 +5,16 @@ import (
 	"fmt"
 	"log"
 	"math"
+	"sync"
 	"time"
 
 	"github.com/bosun-monitor/bosun/_third_party/github.com/MiniProfiler/go/miniprofiler"
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/collect"
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
+	"github.com/bosun-monitor/bosun/cache"
 	"github.com/bosun-monitor/bosun/conf"
 	"github.com/bosun-monitor/bosun/expr"
+	"github.com/bosun-monitor/bosun/graphite"
 )
 
 func (s *Schedule) Status(ak expr.AlertKey) *State {
@@ -31,36 +34,281 @@ func (s *Schedule) Status(ak expr.AlertKey) *State {
 }
 
 type RunHistory struct {
-	Start   time.Time
-	Context opentsdb.Context
-	Events  map[expr.AlertKey]*Event
+	Start           time.Time
+	Context         opentsdb.Context
+	GraphiteContext graphite.Context
+	Events          map[expr.AlertKey]*Event
+
+	// staged, if not nil, holds the results of the run instead of its alert
+	// states, see record.
+	staged map[expr.AlertKey]*Result
+	// deadline, if not zero, is the time after which queries fail.
+	deadline time.Time
 }
 
 func (s *Schedule) NewRunHistory(start time.Time) *RunHistory {
+	tc, gc := s.Contexts()
 	return &RunHistory{
-		Start:   start,
-		Context: opentsdb.NewCache(s.Conf.TsdbHost, s.Conf.ResponseLimit),
-		Events:  make(map[expr.AlertKey]*Event),
+		Start:           start,
+		Context:         tc,
+		GraphiteContext: gc,
+		Events:          make(map[expr.AlertKey]*Event),
+	}
+}
+
+// Contexts returns the OpenTSDB and Graphite contexts for one check run or web
+// request. At most queryConcurrency of their queries are in flight at once,
+// and OpenTSDB responses are shared through the query cache if one is
+// configured.
+func (s *Schedule) Contexts() (opentsdb.Context, graphite.Context) {
+	c := s.Config()
+	limit := make(queryLimit, c.QueryConcurrency)
+	return s.tsdbContext(&limitContext{cache.NewMemo(c.TsdbHost, c.ResponseLimit), limit}),
+		&limitGraphiteContext{graphite.NewCache(c.GraphiteHost, c.ResponseLimit), limit}
+}
+
+// queryLimit bounds the number of queries in flight during a run.
+type queryLimit chan bool
+
+func (q queryLimit) acquire() { q <- true }
+func (q queryLimit) release() { <-q }
+
+type limitContext struct {
+	opentsdb.Context
+	limit queryLimit
+}
+
+func (c *limitContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	c.limit.acquire()
+	defer c.limit.release()
+	return c.Context.Query(r)
+}
+
+type limitGraphiteContext struct {
+	graphite.Context
+	limit queryLimit
+}
+
+func (c *limitGraphiteContext) Query(r *graphite.Request) (graphite.Response, error) {
+	c.limit.acquire()
+	defer c.limit.release()
+	return c.Context.Query(r)
+}
+
+// budget bounds the queries, datapoints and time used by one expression check
+// of an alert.
+type budget struct {
+	alert    *conf.Alert
+	deadline time.Time
+	timeout  time.Time
+	sync.Mutex
+	queries    int
+	datapoints int
+}
+
+// newBudget returns the budget of a check of a. Queries fail after timeout if
+// it is not zero.
+func newBudget(a *conf.Alert, timeout time.Time) *budget {
+	b := &budget{alert: a, timeout: timeout}
+	if a.MaxDuration > 0 {
+		b.deadline = time.Now().Add(a.MaxDuration)
+	}
+	return b
+}
+
+// add records the use of queries and datapoints, and returns an error if a
+// limit has been exceeded.
+func (b *budget) add(queries, points int) error {
+	b.Lock()
+	b.queries += queries
+	b.datapoints += points
+	q, p := b.queries, b.datapoints
+	b.Unlock()
+	if max := b.alert.MaxQueries; max > 0 && q > max {
+		return fmt.Errorf("query budget exceeded: more than %d queries (maxQueries)", max)
+	}
+	if max := b.alert.MaxDatapoints; max > 0 && p > max {
+		return fmt.Errorf("datapoint budget exceeded: more than %d datapoints (maxDatapoints)", max)
+	}
+	return b.checkTime()
+}
+
+func (b *budget) checkTime() error {
+	if !b.timeout.IsZero() && time.Now().After(b.timeout) {
+		return fmt.Errorf("alert check timed out")
+	}
+	if !b.deadline.IsZero() && time.Now().After(b.deadline) {
+		return fmt.Errorf("time budget exceeded: took more than %v (maxDuration)", b.alert.MaxDuration)
 	}
+	return nil
 }
 
-// Check evaluates all critical and warning alert rules. An error is returned if
-// the check could not be performed.
+type budgetContext struct {
+	opentsdb.Context
+	*budget
+}
+
+func (c *budgetContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	if err := c.add(1, 0); err != nil {
+		return nil, err
+	}
+	rs, err := c.Context.Query(r)
+	if err != nil {
+		return nil, err
+	}
+	points := 0
+	for _, r := range rs {
+		points += len(r.DPS)
+	}
+	if err := c.add(0, points); err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+type budgetGraphiteContext struct {
+	graphite.Context
+	*budget
+}
+
+func (c *budgetGraphiteContext) Query(r *graphite.Request) (graphite.Response, error) {
+	if err := c.add(1, 0); err != nil {
+		return nil, err
+	}
+	resp, err := c.Context.Query(r)
+	if err != nil {
+		return nil, err
+	}
+	points := 0
+	for _, s := range resp {
+		points += len(s.Datapoints)
+	}
+	if err := c.add(0, points); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// RunEvery returns the time between checks of a.
+func (s *Schedule) RunEvery(a *conf.Alert) time.Duration {
+	return runEvery(s.Config(), a)
+}
+
+func runEvery(c *conf.Conf, a *conf.Alert) time.Duration {
+	if a.RunEvery != 0 {
+		return a.RunEvery
+	}
+	return c.CheckFrequency
+}
+
+// CheckInterval returns the time between runs of the scheduler: the greatest
+// common divisor of the intervals of all alerts, so that each alert is due on
+// a run.
+func (s *Schedule) CheckInterval() time.Duration {
+	return checkInterval(s.Config())
+}
+
+func checkInterval(c *conf.Conf) time.Duration {
+	d := c.CheckFrequency
+	for _, a := range c.Alerts {
+		e := runEvery(c, a)
+		for e != 0 {
+			d, e = e, d%e
+		}
+	}
+	return d
+}
+
+// dueAlerts returns the alerts due to be checked at now, and marks them as
+// next due one interval after they were last due. An alert that has not been
+// checked yet, or that has missed a whole interval, is next due one interval
+// after now.
+func (s *Schedule) dueAlerts(now time.Time) []*conf.Alert {
+	var due []*conf.Alert
+	s.Lock()
+	defer s.Unlock()
+	for name, a := range s.Conf.Alerts {
+		next, ok := s.nextRun[name]
+		if ok && next.After(now) {
+			continue
+		}
+		every := s.RunEvery(a)
+		if !ok || !next.Add(every).After(now) {
+			next = now
+		}
+		s.nextRun[name] = next.Add(every)
+		due = append(due, a)
+	}
+	return due
+}
+
+// allAlerts returns every alert, leaving when they are next due unchanged.
+func (s *Schedule) allAlerts(now time.Time) []*conf.Alert {
+	var all []*conf.Alert
+	for _, a := range s.Config().Alerts {
+		all = append(all, a)
+	}
+	return all
+}
+
+// Check evaluates the critical and warning rules of all alerts due at now. An
+// error is returned if the check could not be performed.
 func (s *Schedule) Check(T miniprofiler.Timer, now time.Time) (time.Duration, error) {
+	return s.check(T, now, s.dueAlerts)
+}
+
+// CheckAll evaluates the critical and warning rules of all alerts at now,
+// whether or not they are due. When each alert is next due is not changed.
+func (s *Schedule) CheckAll(T miniprofiler.Timer, now time.Time) (time.Duration, error) {
+	return s.check(T, now, s.allAlerts)
+}
+
+func (s *Schedule) check(T miniprofiler.Timer, now time.Time, alertsAt func(time.Time) []*conf.Alert) (time.Duration, error) {
 	select {
 	case s.checkRunning <- true:
 		// Good, we've got the lock.
 	default:
 		return 0, fmt.Errorf("check already running")
 	}
+	defer func() { <-s.checkRunning }()
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	c := s.Config()
+	due := alertsAt(now)
 	r := s.NewRunHistory(now)
 	start := time.Now()
-	for _, a := range s.Conf.Alerts {
-		s.CheckAlert(T, r, a)
+	timeout := c.AlertTimeout
+	if timeout == 0 {
+		timeout = c.CheckFrequency
 	}
+	alerts := make(chan *conf.Alert)
+	workers := c.CheckConcurrency
+	if workers > len(due) {
+		workers = len(due)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for a := range alerts {
+				events := s.checkAlertTimeout(T, r, a, timeout)
+				mu.Lock()
+				for ak, e := range events {
+					r.Events[ak] = e
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, a := range due {
+		alerts <- a
+	}
+	close(alerts)
+	wg.Wait()
 	d := time.Since(start)
 	s.RunHistory(r)
-	<-s.checkRunning
 	return d, nil
 }
 
@@ -133,34 +381,127 @@ func (s *Schedule) RunHistory(r *RunHistory) {
 	s.Save()
 }
 
-// CheckUnknown checks for unknown alerts.
+// CheckUnknown checks for unknown alerts every quarter of the scheduler
+// interval, which is recomputed after each check to follow reloads.
 func (s *Schedule) CheckUnknown() {
-	for _ = range time.Tick(s.Conf.CheckFrequency / 4) {
-		log.Println("checkUnknown")
-		r := s.NewRunHistory(time.Now())
-		s.Lock()
-		for ak, st := range s.status {
-			if st.Forgotten {
-				continue
-			}
-			a := s.Conf.Alerts[ak.Name()]
-			if a.IgnoreUnknown {
-				continue
-			}
-			t := a.Unknown
-			if t == 0 {
-				t = s.Conf.CheckFrequency * 2
-			}
-			if t == 0 {
-				continue
-			}
-			if time.Since(st.Touched) < t {
-				continue
-			}
-			r.Events[ak] = &Event{Status: StUnknown}
+	for {
+		<-time.After(s.CheckInterval() / 4)
+		s.checkUnknown()
+	}
+}
+
+func (s *Schedule) checkUnknown() {
+	log.Println("checkUnknown")
+	// Hold off Reload until the events are processed, since it may remove
+	// the states they apply to.
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	r := s.NewRunHistory(time.Now())
+	s.Lock()
+	for ak, st := range s.status {
+		if st.Forgotten {
+			continue
+		}
+		a := s.Conf.Alerts[ak.Name()]
+		if a == nil || a.IgnoreUnknown {
+			continue
+		}
+		t := a.Unknown
+		if t == 0 {
+			t = s.RunEvery(a) * 2
+		}
+		if t == 0 {
+			continue
+		}
+		if time.Since(st.Touched) < t {
+			continue
+		}
+		r.Events[ak] = &Event{Status: StUnknown}
+	}
+	s.Unlock()
+	s.RunHistory(r)
+}
+
+// checkAlertTimeout checks a against a copy of r with its own event map, and
+// returns the resulting events. If the check does not finish within timeout it
+// is abandoned: its queries fail from then on, its events and results are
+// discarded, and a single error event for the alert is returned instead. A
+// timeout <= 0 disables the limit.
+func (s *Schedule) checkAlertTimeout(T miniprofiler.Timer, r *RunHistory, a *conf.Alert, timeout time.Duration) map[expr.AlertKey]*Event {
+	rh := *r
+	rh.Events = make(map[expr.AlertKey]*Event)
+	if timeout <= 0 {
+		s.CheckAlert(T, &rh, a)
+		return rh.Events
+	}
+	// The check stages its results so that, if abandoned, it never touches
+	// the alert states.
+	rh.staged = make(map[expr.AlertKey]*Result)
+	rh.deadline = time.Now().Add(timeout)
+	done := make(chan bool, 1)
+	go func() {
+		s.CheckAlert(T, &rh, a)
+		done <- true
+	}()
+	select {
+	case <-done:
+		s.applyStaged(&rh)
+		return rh.Events
+	case <-time.After(timeout):
+		err := fmt.Errorf("alert check timed out after %v", timeout)
+		collect.Add("check.errs", opentsdb.TagSet{"metric": a.Name}, 1)
+		log.Printf("%s: %v", a.Name, err)
+		eh := *r
+		eh.Events = make(map[expr.AlertKey]*Event)
+		s.setError(&eh, a, a.Name, err)
+		return eh.Events
+	}
+}
+
+// record notes that ak was checked during rh, with result res if not nil. If
+// rh is staged the state of ak is updated later by applyStaged, otherwise now.
+func (s *Schedule) record(rh *RunHistory, ak expr.AlertKey, res *Result) {
+	if rh.staged != nil {
+		if _, ok := rh.staged[ak]; !ok || res != nil {
+			rh.staged[ak] = res
 		}
-		s.Unlock()
-		s.RunHistory(r)
+		return
+	}
+	state := s.Status(ak)
+	state.Touch()
+	if res != nil {
+		state.Result = res
+	}
+}
+
+// applyStaged updates the alert states with the staged results of rh.
+func (s *Schedule) applyStaged(rh *RunHistory) {
+	for ak, res := range rh.staged {
+		state := s.Status(ak)
+		state.Touch()
+		if res != nil {
+			state.Result = res
+		}
+	}
+	rh.staged = nil
+}
+
+// setError records an error event for a in rh. text is the computation text
+// shown with the error.
+func (s *Schedule) setError(rh *RunHistory, a *conf.Alert, text string, err error) {
+	ak := expr.NewAlertKey(a.Name, nil)
+	s.record(rh, ak, &Result{
+		Result: &expr.Result{
+			Computations: []expr.Computation{
+				{
+					Text:  text,
+					Value: err.Error(),
+				},
+			},
+		},
+	})
+	rh.Events[ak] = &Event{
+		Status: StError,
 	}
 }
 
@@ -176,6 +517,26 @@ func (s *Schedule) CheckAlert(T miniprofiler.Timer, r *RunHistory, a *conf.Alert
 	log.Printf("done checking alert %v (%s): %v crits, %v warns", a.Name, time.Since(start), len(crits), len(warns))
 }
 
+// Evaluate checks the alert named name of c at now, answering OpenTSDB queries
+// from ctx, and returns the status of each resulting alert key. It allows alert
+// rules to be tested against recorded data, see package fixture.
+func Evaluate(c *conf.Conf, name string, ctx opentsdb.Context, now time.Time) (map[expr.AlertKey]Status, error) {
+	a := c.Alerts[name]
+	if a == nil {
+		return nil, fmt.Errorf("unknown alert: %s", name)
+	}
+	s := new(Schedule)
+	s.Init(c)
+	rh := s.NewRunHistory(now)
+	rh.Context = ctx
+	s.CheckAlert(nil, rh, a)
+	status := make(map[expr.AlertKey]Status)
+	for ak, e := range rh.Events {
+		status[ak] = e.Status
+	}
+	return status, nil
+}
+
 func (s *Schedule) CheckExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Alert, e *expr.Expr, checkStatus Status, ignore expr.AlertKeys) (alerts expr.AlertKeys, err error) {
 	if e == nil {
 		return
@@ -187,29 +548,20 @@ func (s *Schedule) CheckExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Alert
 		collect.Add("check.errs", opentsdb.TagSet{"metric": a.Name}, 1)
 		log.Println(err)
 	}()
-	results, _, err := e.Execute(rh.Context, T, rh.Start, 0, a.UnjoinedOK, s.Search, s.Conf.GetLookups(), s.Conf.AlertSquelched(a))
+	// A check abandoned by checkAlertTimeout may outlive a reload.
+	c := s.Config()
+	b := newBudget(a, rh.deadline)
+	results, _, err := e.Execute(&budgetContext{rh.Context, b}, &budgetGraphiteContext{rh.GraphiteContext, b}, T, rh.Start, 0, a.UnjoinedOK, s.Search, c.GetLookups(), c.AlertSquelched(a))
+	if err == nil {
+		err = b.checkTime()
+	}
 	if err != nil {
-		ak := expr.NewAlertKey(a.Name, nil)
-		state := s.Status(ak)
-		state.Touch()
-		state.Result = &Result{
-			Result: &expr.Result{
-				Computations: []expr.Computation{
-					{
-						Text:  e.String(),
-						Value: err.Error(),
-					},
-				},
-			},
-		}
-		rh.Events[ak] = &Event{
-			Status: StError,
-		}
+		s.setError(rh, a, e.String(), err)
 		return
 	}
 Loop:
 	for _, r := range results.Results {
-		if s.Conf.Squelched(a, r.Group) {
+		if c.Squelched(a, r.Group) {
 			continue
 		}
 		ak := expr.NewAlertKey(a.Name, r.Group)
@@ -218,8 +570,7 @@ Loop:
 				continue Loop
 			}
 		}
-		state := s.Status(ak)
-		state.Touch()
+		s.record(rh, ak, nil)
 		status := checkStatus
 		var n float64
 		switch v := r.Value.(type) {
@@ -256,7 +607,7 @@ Loop:
 		}
 		if status > rh.Events[ak].Status {
 			event.Status = status
-			state.Result = &result
+			s.record(rh, ak, &result)
 		}
 	}
 	return
@@ -18,6 +18,7 @@ import (
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bradfitz/slice"
 	"github.com/bosun-monitor/bosun/_third_party/github.com/tatsushid/go-fastping"
+	"github.com/bosun-monitor/bosun/cache"
 	"github.com/bosun-monitor/bosun/conf"
 	"github.com/bosun-monitor/bosun/expr"
 	"github.com/bosun-monitor/bosun/search"
@@ -45,6 +46,16 @@ type Schedule struct {
 	notifications map[*conf.Notification][]*State
 	metalock      sync.Mutex
 	checkRunning  chan bool
+	// runLock serializes checks, unknown checks and reloads.
+	runLock sync.Mutex
+	// confLock guards Conf, Lookups and queryCache against Reload for code
+	// that does not hold the schedule lock.
+	confLock sync.RWMutex
+	// alert name -> time the alert is next due to be checked
+	nextRun map[string]time.Time
+	// OpenTSDB responses shared between check runs and web requests, nil if
+	// disabled
+	queryCache *cache.Cache
 }
 
 type Metavalues []Metavalue
@@ -280,7 +291,7 @@ type StateGroups struct {
 
 func (s *Schedule) MarshalGroups(filter string) (*StateGroups, error) {
 	t := StateGroups{
-		TimeAndDate: s.Conf.TimeAndDate,
+		TimeAndDate: s.Config().TimeAndDate,
 		Silenced:    s.Silenced(),
 	}
 	s.Lock()
@@ -373,6 +384,14 @@ func Load(c *conf.Conf) {
 	DefaultSched.Load(c)
 }
 
+// Config returns the configuration of s. Code that holds neither the schedule
+// lock nor runs a check must use it rather than Conf, which Reload replaces.
+func (s *Schedule) Config() *conf.Conf {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	return s.Conf
+}
+
 // Runs the default schedule.
 func Run() error {
 	return DefaultSched.Run()
@@ -387,6 +406,23 @@ func (s *Schedule) Init(c *conf.Conf) {
 	s.status = make(States)
 	s.Search = search.NewSearch()
 	s.checkRunning = make(chan bool, 1)
+	s.nextRun = make(map[string]time.Time)
+	if c.QueryCacheSize > 0 {
+		s.queryCache = cache.New("query", c.QueryCacheSize)
+	}
+}
+
+func (s *Schedule) tsdbContext(c opentsdb.Context) opentsdb.Context {
+	s.confLock.RLock()
+	defer s.confLock.RUnlock()
+	if s.queryCache == nil {
+		return c
+	}
+	return &cache.TSDB{
+		Cache:   s.queryCache,
+		Context: c,
+		TTL:     s.Conf.QueryCacheTTL,
+	}
 }
 
 func (s *Schedule) Load(c *conf.Conf) {
@@ -446,33 +482,11 @@ func (s *Schedule) RestoreState() {
 		return
 	}
 	for ak, st := range status {
-		if a, present := s.Conf.Alerts[ak.Name()]; !present {
-			log.Println("sched: alert no longer present, ignoring:", ak)
+		if !s.keepState(ak, st) {
 			continue
-		} else if s.Conf.Squelched(a, st.Group) {
-			log.Println("sched: alert now squelched:", ak)
-			continue
-		} else if st.Status().IsUnknown() && a.IgnoreUnknown {
-			log.Println("sched: alert now disregards unknown:", ak)
-			continue
-		} else {
-			t := a.Unknown
-			if t == 0 {
-				t = s.Conf.CheckFrequency
-			}
-			if t == 0 && st.Last().Status == StUnknown {
-				st.Append(&Event{Status: StNormal})
-			}
 		}
 		s.status[ak] = st
-		for name, t := range notifications[ak] {
-			n, present := s.Conf.Notifications[name]
-			if !present {
-				log.Println("sched: notification not present during restore:", name)
-				continue
-			}
-			s.AddNotification(ak, n, t)
-		}
+		s.restoreNotifications(ak, notifications[ak])
 	}
 	if err := dec.Decode(&s.Metadata); err != nil {
 		log.Println(err)
@@ -480,6 +494,106 @@ func (s *Schedule) RestoreState() {
 	}
 }
 
+// keepState reports whether the state st of ak still applies to the
+// configuration of s. st is updated if needed.
+func (s *Schedule) keepState(ak expr.AlertKey, st *State) bool {
+	a, present := s.Conf.Alerts[ak.Name()]
+	if !present {
+		log.Println("sched: alert no longer present, ignoring:", ak)
+		return false
+	} else if s.Conf.Squelched(a, st.Group) {
+		log.Println("sched: alert now squelched:", ak)
+		return false
+	} else if st.Status().IsUnknown() && a.IgnoreUnknown {
+		log.Println("sched: alert now disregards unknown:", ak)
+		return false
+	}
+	t := a.Unknown
+	if t == 0 {
+		t = s.RunEvery(a)
+	}
+	if t == 0 && st.Last().Status == StUnknown {
+		st.Append(&Event{Status: StNormal})
+	}
+	return true
+}
+
+// restoreNotifications adds the pending notifications of ak that are still
+// configured, keeping their start times.
+func (s *Schedule) restoreNotifications(ak expr.AlertKey, notifications map[string]time.Time) {
+	for name, t := range notifications {
+		n, present := s.Conf.Notifications[name]
+		if !present {
+			log.Println("sched: notification not present during restore:", name)
+			continue
+		}
+		s.AddNotification(ak, n, t)
+	}
+}
+
+// Reload replaces the configuration of s with c, waiting for any running
+// check to finish. Alert states and pending notifications are kept if they
+// still apply to c, as in RestoreState; a renamed alert starts with no state.
+// Alerts that were added or changed are checked on the next run. Settings
+// that need a restart to take effect must not change.
+func (s *Schedule) Reload(c *conf.Conf) error {
+	if c.CheckFrequency < time.Second {
+		return fmt.Errorf("sched: frequency must be > 1 second")
+	}
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+	s.Lock()
+	defer s.Unlock()
+	old := s.Conf
+	switch {
+	case c.HttpListen != old.HttpListen:
+		return fmt.Errorf("sched: changing httpListen requires a restart")
+	case c.TsdbHost != old.TsdbHost:
+		return fmt.Errorf("sched: changing tsdbHost requires a restart")
+	case c.RelayListen != old.RelayListen:
+		return fmt.Errorf("sched: changing relayListen requires a restart")
+	case c.WebDir != old.WebDir:
+		return fmt.Errorf("sched: changing webDir requires a restart")
+	}
+	s.confLock.Lock()
+	s.Conf = c
+	s.Lookups = c.GetLookups()
+	if c.QueryCacheSize != old.QueryCacheSize {
+		s.queryCache = nil
+		if c.QueryCacheSize > 0 {
+			s.queryCache = cache.New("query", c.QueryCacheSize)
+		}
+	}
+	s.confLock.Unlock()
+	// Alerts are next due on runs of the old interval, which may not be
+	// runs of the new one.
+	if checkInterval(c) != checkInterval(old) {
+		s.nextRun = make(map[string]time.Time)
+	}
+	for name := range s.nextRun {
+		a, o := c.Alerts[name], old.Alerts[name]
+		if a == nil || o == nil || a.Def != o.Def || a.RunEvery != o.RunEvery || c.CheckFrequency != old.CheckFrequency {
+			delete(s.nextRun, name)
+		}
+	}
+	notifications := s.Notifications
+	s.Notifications = nil
+	for ak, st := range s.status {
+		if !s.keepState(ak, st) {
+			delete(s.status, ak)
+			continue
+		}
+		s.restoreNotifications(ak, notifications[ak])
+	}
+	// Wake Poll to recompute notification timeouts.
+	select {
+	case s.nc <- true:
+	default:
+	}
+	log.Println("sched: reloaded configuration from", c.Name)
+	return nil
+}
+
 var savePending bool
 
 func (s *Schedule) Save() {
@@ -590,28 +704,38 @@ func (s *Schedule) save() {
 
 func (s *Schedule) Run() error {
 	s.nc = make(chan interface{}, 1)
-	if s.Conf.Ping {
+	if s.Config().Ping {
 		go s.PingHosts()
 	}
 	go s.Poll()
 	go s.CheckUnknown()
+	// Runs are at multiples of the check interval after the first, and are
+	// passed that time rather than the time they start, so alerts due on a run
+	// are not delayed by timer jitter.
+	now := time.Now()
 	for {
-		wait := time.After(s.Conf.CheckFrequency)
-		if s.Conf.CheckFrequency < time.Second {
-			return fmt.Errorf("sched: frequency must be > 1 second")
-		}
-		if s.Conf == nil {
+		c := s.Config()
+		if c == nil {
 			return fmt.Errorf("sched: nil configuration")
 		}
+		if c.CheckFrequency < time.Second {
+			return fmt.Errorf("sched: frequency must be > 1 second")
+		}
 		log.Println("starting check")
-		now := time.Now()
 		dur, err := s.Check(nil, now)
 		if err != nil {
 			log.Println(err)
 		}
 		log.Printf("check took %v\n", dur)
 		s.LastCheck = now
-		<-wait
+		interval := s.CheckInterval()
+		next := now.Add(interval)
+		if late := time.Since(next); late >= 0 {
+			// Skip runs missed by a slow check.
+			next = next.Add((late/interval + 1) * interval)
+		}
+		time.Sleep(next.Sub(time.Now()))
+		now = next
 	}
 }
 
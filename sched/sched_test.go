@@ -8,11 +8,14 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/bosun-monitor/bosun/_third_party/github.com/bosun-monitor/scollector/opentsdb"
 	"github.com/bosun-monitor/bosun/conf"
+	"github.com/bosun-monitor/bosun/expr"
+	"github.com/bosun-monitor/bosun/fixture"
 )
 
 func init() {
@@ -26,6 +29,8 @@ type schedState struct {
 type schedTest struct {
 	conf    string
 	queries map[string]opentsdb.ResponseSet
+	// query -> time to wait before responding
+	delay map[string]time.Duration
 	// state -> active
 	state map[schedState]bool
 }
@@ -44,6 +49,7 @@ func testSched(t *testing.T, st *schedTest) {
 				t.Errorf("unknown query: %s", qs)
 				return
 			}
+			time.Sleep(st.delay[qs])
 			resp = append(resp, q...)
 		}
 		if err := json.NewEncoder(w).Encode(&resp); err != nil {
@@ -171,3 +177,362 @@ func TestCount(t *testing.T) {
 		},
 	})
 }
+
+func TestAlertTimeout(t *testing.T) {
+	testSched(t, &schedTest{
+		conf: `alertTimeout = 1s
+		alert a {
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+		}
+		alert slow {
+			crit = avg(q("avg:n{a=b}", "5m", "")) > 0
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", "2000/01/01-11:55:00", "2000/01/01-12:00:00")`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+			`q("avg:n{a=b}", "2000/01/01-11:55:00", "2000/01/01-12:00:00")`: {
+				{
+					Metric: "n",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+		},
+		delay: map[string]time.Duration{
+			`q("avg:n{a=b}", "2000/01/01-11:55:00", "2000/01/01-12:00:00")`: time.Second * 2,
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}: true,
+			schedState{"slow{}", "error"}:    true,
+		},
+	})
+}
+
+func TestBudget(t *testing.T) {
+	testSched(t, &schedTest{
+		conf: `alert a {
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+			maxQueries = 1
+			maxDatapoints = 2
+		}
+		alert queries {
+			crit = avg(q("avg:m{a=b}", "5m", "")) + avg(q("avg:m{a=b}", "10m", "")) > 0
+			maxQueries = 1
+		}
+		alert datapoints {
+			crit = avg(q("avg:n{a=b}", "5m", "")) > 0
+			maxDatapoints = 2
+		}`,
+		queries: map[string]opentsdb.ResponseSet{
+			`q("avg:m{a=b}", "2000/01/01-11:55:00", "2000/01/01-12:00:00")`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1, "1": 1},
+				},
+			},
+			`q("avg:m{a=b}", "2000/01/01-11:50:00", "2000/01/01-12:00:00")`: {
+				{
+					Metric: "m",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1},
+				},
+			},
+			`q("avg:n{a=b}", "2000/01/01-11:55:00", "2000/01/01-12:00:00")`: {
+				{
+					Metric: "n",
+					Tags:   opentsdb.TagSet{"a": "b"},
+					DPS:    map[string]opentsdb.Point{"0": 1, "1": 1, "2": 1},
+				},
+			},
+		},
+		state: map[schedState]bool{
+			schedState{"a{a=b}", "critical"}:    true,
+			schedState{"queries{}", "error"}:    true,
+			schedState{"datapoints{}", "error"}: true,
+		},
+	})
+}
+
+func TestEvaluate(t *testing.T) {
+	c, err := conf.New("testconf", `tsdbHost = localhost:4242
+		alert cpu {
+			crit = avg(q("avg:os.cpu{host=*}", "1h", "")) > 85
+			warn = avg(q("avg:os.cpu{host=*}", "1h", "")) > 25
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fixture.Load("../fixture/testdata/cpu.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := Evaluate(c, "cpu", f, time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[expr.AlertKey]Status{
+		"cpu{host=ny-web01}": StWarning,
+		"cpu{host=ny-web02}": StCritical,
+	}
+	if len(status) != len(expect) {
+		t.Errorf("expected %v, got %v", expect, status)
+	}
+	for ak, st := range expect {
+		if status[ak] != st {
+			t.Errorf("%v: expected %v, got %v", ak, st, status[ak])
+		}
+	}
+	if _, err := Evaluate(c, "missing", f, time.Now()); err == nil {
+		t.Error("expected error for unknown alert")
+	}
+}
+
+func TestRunEvery(t *testing.T) {
+	var mu sync.Mutex
+	queries := make(map[string]int)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req opentsdb.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			log.Fatal(err)
+		}
+		mu.Lock()
+		queries[req.Queries[0].Metric]++
+		mu.Unlock()
+		fmt.Fprint(w, "[]")
+	}))
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := conf.New("testconf", `tsdbHost = `+u.Host+`
+		checkFrequency = 1m
+		alert a {
+			crit = avg(q("avg:a", "5m", "")) > 0
+		}
+		alert b {
+			runEvery = 3m
+			crit = avg(q("avg:b", "5m", "")) > 0
+		}
+		alert c {
+			runEvery = 30s
+			crit = avg(q("avg:c", "5m", "")) > 0
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	s := new(Schedule)
+	s.Init(c)
+	if d := s.CheckInterval(); d != time.Second*30 {
+		t.Errorf("expected 30s check interval, got %v", d)
+	}
+	start := time.Date(2000, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i++ {
+		// Simulate timer jitter.
+		s.Check(nil, start.Add(time.Second*time.Duration(30*i)+time.Millisecond*time.Duration(i%2)))
+	}
+	expect := map[string]int{"a": 5, "b": 2, "c": 10}
+	for m, n := range expect {
+		if queries[m] != n {
+			t.Errorf("%s: expected %v checks, got %v", m, n, queries[m])
+		}
+	}
+}
+
+func TestCheckMixedIntervals(t *testing.T) {
+	c, err := conf.New("testconf", `tsdbHost = localhost:4242
+		checkFrequency = 5m
+		alert a {
+			runEvery = 2m
+			crit = 1
+		}
+		alert b {
+			crit = 1
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	s := new(Schedule)
+	s.Init(c)
+	interval := s.CheckInterval()
+	if interval != time.Minute {
+		t.Fatalf("expected 1m check interval, got %v", interval)
+	}
+	start := time.Date(2000, time.January, 1, 12, 0, 0, 0, time.UTC)
+	runs := make(map[string][]time.Duration)
+	for i := 0; i <= 20; i++ {
+		// Simulate timer jitter.
+		now := start.Add(interval*time.Duration(i) + time.Millisecond*time.Duration(i%3))
+		for _, a := range s.dueAlerts(now) {
+			runs[a.Name] = append(runs[a.Name], now.Sub(start).Truncate(time.Second))
+		}
+	}
+	expect := map[string]string{
+		"a": "[0s 2m0s 4m0s 6m0s 8m0s 10m0s 12m0s 14m0s 16m0s 18m0s 20m0s]",
+		"b": "[0s 5m0s 10m0s 15m0s 20m0s]",
+	}
+	for name, e := range expect {
+		if got := fmt.Sprint(runs[name]); got != e {
+			t.Errorf("%s: expected runs at %s, got %s", name, e, got)
+		}
+	}
+	// A manual run checks every alert without moving when they are next due.
+	next := fmt.Sprint(s.nextRun)
+	if _, err := s.CheckAll(nil, start.Add(interval*21)); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(s.nextRun); got != next {
+		t.Errorf("expected next runs %s, got %s", next, got)
+	}
+	for _, name := range []string{"a", "b"} {
+		if s.status[expr.NewAlertKey(name, nil)] == nil {
+			t.Errorf("expected %s to be checked", name)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	const text = `tsdbHost = localhost:4242
+		notification n {
+			print = true
+		}
+		alert a {
+			crit = 1
+			critNotification = n
+		}
+		alert %s {
+			crit = 1
+			critNotification = n
+		}`
+	c, err := conf.New("testconf", fmt.Sprintf(text, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := new(Schedule)
+	s.Init(c)
+	started := time.Date(2000, time.January, 1, 12, 0, 0, 0, time.UTC)
+	for _, name := range []string{"a", "b"} {
+		ak := expr.NewAlertKey(name, opentsdb.TagSet{"host": "x"})
+		s.status[ak] = &State{
+			Alert:   name,
+			Group:   opentsdb.TagSet{"host": "x"},
+			History: []Event{{Status: StCritical, Time: started}},
+		}
+		s.AddNotification(ak, c.Notifications["n"], started)
+		s.nextRun[name] = started
+	}
+	// b is renamed to c.
+	nc, err := conf.New("testconf", fmt.Sprintf(text, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(nc); err != nil {
+		t.Fatal(err)
+	}
+	if s.Conf != nc {
+		t.Error("expected new configuration")
+	}
+	a := expr.AlertKey("a{host=x}")
+	if len(s.status) != 1 || s.status[a] == nil {
+		t.Errorf("expected only state of a, got %v", s.status)
+	}
+	if len(s.Notifications) != 1 || !s.Notifications[a]["n"].Equal(started) {
+		t.Errorf("expected only notification of a, got %v", s.Notifications)
+	}
+	if _, ok := s.nextRun["a"]; !ok || len(s.nextRun) != 1 {
+		t.Errorf("expected only next run of a, got %v", s.nextRun)
+	}
+	bad, err := conf.New("testconf", "httpListen = :1234\n"+fmt.Sprintf(text, "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(bad); err == nil || s.Conf != nc {
+		t.Error("expected httpListen change to be rejected")
+	}
+}
+
+func TestCheckUnknownRemovedAlert(t *testing.T) {
+	c, err := conf.New("testconf", `tsdbHost = localhost:4242
+		alert a {
+			crit = 1
+		}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	s := new(Schedule)
+	s.Init(c)
+	// A state left for an alert no longer in the configuration.
+	s.Status(expr.NewAlertKey("gone", nil))
+	s.checkUnknown()
+	if st := s.status["gone{}"]; len(st.History) != 0 {
+		t.Errorf("unexpected events: %v", st.History)
+	}
+}
+
+// slowContext answers every query with one series after delay, and signals
+// each answer on done.
+type slowContext struct {
+	delay time.Duration
+	done  chan bool
+}
+
+func (c *slowContext) Query(r *opentsdb.Request) (opentsdb.ResponseSet, error) {
+	time.Sleep(c.delay)
+	defer func() { c.done <- true }()
+	return opentsdb.ResponseSet{
+		{
+			Metric: "m",
+			Tags:   opentsdb.TagSet{"a": "b"},
+			DPS:    map[string]opentsdb.Point{"0": 1},
+		},
+	}, nil
+}
+
+func TestAlertTimeoutDiscarded(t *testing.T) {
+	c, err := conf.New("test", `
+		tsdbHost = localhost:4242
+		alert a {
+			crit = avg(q("avg:m{a=b}", "5m", "")) > 0
+			warn = avg(q("avg:m{a=b}", "10m", "")) > 0
+		}
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.StateFile = ""
+	s := new(Schedule)
+	s.Init(c)
+	ctx := &slowContext{delay: time.Millisecond * 200, done: make(chan bool, 2)}
+	r := s.NewRunHistory(time.Now())
+	r.Context = ctx
+	events := s.checkAlertTimeout(nil, r, c.Alerts["a"], time.Millisecond*50)
+	ak := expr.AlertKey("a{}")
+	if e := events[ak]; e == nil || e.Status != StError {
+		t.Fatalf("expected error event, got %v", events)
+	}
+	// The abandoned check finishes its query, then stops.
+	<-ctx.done
+	time.Sleep(time.Millisecond * 300)
+	select {
+	case <-ctx.done:
+		t.Error("query sent after the timeout")
+	default:
+	}
+	s.Lock()
+	defer s.Unlock()
+	if len(s.status) != 1 {
+		t.Fatalf("expected only the error state, got %v", s.status)
+	}
+	if v := s.status[ak].Result.Computations[0].Value; v != "alert check timed out after 50ms" {
+		t.Errorf("unexpected result: %v", v)
+	}
+}
@@ -61,11 +61,12 @@ func (s *Schedule) unknownData(t time.Time, name string, group expr.AlertKeys) *
 
 // URL returns a prepopulated URL for external access, with path and query empty.
 func (s *Schedule) URL() *url.URL {
+	listen := s.Config().HttpListen
 	u := url.URL{
 		Scheme: "http",
-		Host:   s.Conf.HttpListen,
+		Host:   listen,
 	}
-	if strings.HasPrefix(s.Conf.HttpListen, ":") {
+	if strings.HasPrefix(listen, ":") {
 		h, err := os.Hostname()
 		if err != nil {
 			u.Host = "localhost" + u.Host
@@ -96,13 +97,14 @@ func (c *Context) HostView(host string) string {
 }
 
 func (c *Context) makeLink(path string, v *url.Values) (string, error) {
+	listen := c.schedule.Config().HttpListen
 	u := url.URL{
 		Scheme:   "http",
-		Host:     c.schedule.Conf.HttpListen,
+		Host:     listen,
 		Path:     path,
 		RawQuery: v.Encode(),
 	}
-	if strings.HasPrefix(c.schedule.Conf.HttpListen, ":") {
+	if strings.HasPrefix(listen, ":") {
 		h, err := os.Hostname()
 		if err != nil {
 			return "", err
@@ -119,7 +121,7 @@ func (c *Context) Expr(v string) (string, error) {
 }
 
 func (c *Context) Rule() (string, error) {
-	t, err := c.schedule.Conf.AlertTemplateStrings()
+	t, err := c.schedule.Config().AlertTemplateStrings()
 	if err != nil {
 		return "", err
 	}
@@ -171,7 +173,8 @@ func (c *Context) eval(v interface{}, filter bool, series bool, autods int) ([]*
 	if series && e.Root.Return() != parse.TYPE_SERIES {
 		return nil, "", fmt.Errorf("egraph: requires an expression that returns a series")
 	}
-	res, _, err := e.Execute(c.runHistory.Context, nil, c.runHistory.Start, autods, c.Alert.UnjoinedOK, c.schedule.Search, c.schedule.Lookups, c.schedule.Conf.AlertSquelched(c.Alert))
+	cf := c.schedule.Config()
+	res, _, err := e.Execute(c.runHistory.Context, c.runHistory.GraphiteContext, nil, c.runHistory.Start, autods, c.Alert.UnjoinedOK, c.schedule.Search, cf.GetLookups(), cf.AlertSquelched(c.Alert))
 	if err != nil {
 		return nil, "", fmt.Errorf("%s: %v", v, err)
 	}
@@ -195,7 +198,7 @@ func (c *Context) LookupAll(table, key string, group interface{}) (string, error
 	case opentsdb.TagSet:
 		t = v
 	}
-	l, ok := c.schedule.Lookups[table]
+	l, ok := c.schedule.Config().GetLookups()[table]
 	if !ok {
 		return "", fmt.Errorf("unknown lookup table %v", table)
 	}
@@ -106,7 +106,7 @@ func Graph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interf
 	var tr opentsdb.ResponseSet
 	b, _ := json.MarshalIndent(oreq, "", "  ")
 	t.StepCustomTiming("tsdb", "query", string(b), func() {
-		tr, err = oreq.Query(schedule.Conf.TsdbHost)
+		tr, err = oreq.Query(schedule.Config().TsdbHost)
 	})
 	if err != nil {
 		return nil, err
@@ -193,7 +193,8 @@ func ExprGraph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (in
 	} else if e.Root.Return() != parse.TYPE_SERIES {
 		return nil, fmt.Errorf("egraph: requires an expression that returns a series")
 	}
-	res, _, err := e.Execute(opentsdb.NewCache(schedule.Conf.TsdbHost, schedule.Conf.ResponseLimit), t, now, autods, false, schedule.Search, schedule.Lookups, nil)
+	tsdbContext, graphiteContext := schedule.Contexts()
+	res, _, err := e.Execute(tsdbContext, graphiteContext, t, now, autods, false, schedule.Search, schedule.Config().GetLookups(), nil)
 	if err != nil {
 		return nil, err
 	}
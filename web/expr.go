@@ -29,7 +29,15 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 	if err != nil {
 		return nil, err
 	}
-	res, queries, err := e.Execute(opentsdb.NewCache(schedule.Conf.TsdbHost, schedule.Conf.ResponseLimit), t, now, 0, false, schedule.Search, schedule.Lookups, nil)
+	tsdbContext, graphiteContext := schedule.Contexts()
+	var res *expr.Results
+	var queries []opentsdb.Request
+	var trace *expr.Trace
+	if r.FormValue("explain") != "" {
+		res, queries, trace, err = e.Explain(tsdbContext, graphiteContext, t, now, 0, false, schedule.Search, schedule.Config().GetLookups(), nil)
+	} else {
+		res, queries, err = e.Execute(tsdbContext, graphiteContext, t, now, 0, false, schedule.Search, schedule.Config().GetLookups(), nil)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -42,10 +50,12 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 		Type    string
 		Results []*expr.Result
 		Queries map[string]opentsdb.Request
+		Trace   *expr.Trace `json:",omitempty"`
 	}{
 		e.Tree.Root.Return().String(),
 		res.Results,
 		make(map[string]opentsdb.Request),
+		trace,
 	}
 	for _, q := range queries {
 		if e, err := url.QueryUnescape(q.String()); err == nil {
@@ -55,6 +65,29 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 	return ret, nil
 }
 
+// ExprFormat returns the canonical text of the expression q, broken over lines
+// longer than width columns (default 80). A width of 0 returns a single line.
+// Redundant parentheses are removed unless simplify is false.
+func ExprFormat(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	e, err := expr.New(r.FormValue("q"))
+	if err != nil {
+		return nil, err
+	}
+	width := 80
+	if s := r.FormValue("width"); s != "" {
+		if width, err = strconv.Atoi(s); err != nil {
+			return nil, err
+		}
+	}
+	simplify := true
+	if s := r.FormValue("simplify"); s != "" {
+		if simplify, err = strconv.ParseBool(s); err != nil {
+			return nil, err
+		}
+	}
+	return e.Tree.Format(width, simplify), nil
+}
+
 func getTime(r *http.Request) (now time.Time, err error) {
 	now = time.Now().UTC()
 	if fd := r.FormValue("date"); len(fd) > 0 {
@@ -149,7 +182,7 @@ func procRule(t miniprofiler.Timer, c *conf.Conf, a *conf.Alert, now time.Time,
 			}
 			email := new(bytes.Buffer)
 			attachments, err := s.ExecuteBody(email, rh, a, instance, true)
-			n.DoEmail(subject.Bytes(), email.Bytes(), schedule.Conf, string(instance.AlertKey()), attachments...)
+			n.DoEmail(subject.Bytes(), email.Bytes(), schedule.Config(), string(instance.AlertKey()), attachments...)
 		}
 	}
 	return &ruleResult{
@@ -212,22 +245,27 @@ func Rule(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interfa
 	} else if !fz && tz && intervals > 1 {
 		return nil, fmt.Errorf("cannot specify intervals without from and to")
 	}
+	sc := schedule.Config()
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "tsdbHost = %s\n", schedule.Conf.TsdbHost)
-	fmt.Fprintf(&buf, "smtpHost = %s\n", schedule.Conf.SmtpHost)
-	fmt.Fprintf(&buf, "emailFrom = %s\n", schedule.Conf.EmailFrom)
-	fmt.Fprintf(&buf, "responseLimit = %d\n", schedule.Conf.ResponseLimit)
-	for k, v := range schedule.Conf.Vars {
+	fmt.Fprintf(&buf, "tsdbHost = %s\n", sc.TsdbHost)
+	if sc.GraphiteHost != "" {
+		fmt.Fprintf(&buf, "graphiteHost = %s\n", sc.GraphiteHost)
+	}
+	fmt.Fprintf(&buf, "smtpHost = %s\n", sc.SmtpHost)
+	fmt.Fprintf(&buf, "emailFrom = %s\n", sc.EmailFrom)
+	fmt.Fprintf(&buf, "responseLimit = %d\n", sc.ResponseLimit)
+	fmt.Fprintf(&buf, "queryConcurrency = %d\n", sc.QueryConcurrency)
+	for k, v := range sc.Vars {
 		if strings.HasPrefix(k, "$") {
 			fmt.Fprintf(&buf, "%s=%s\n", k, v)
 		}
 	}
-	for _, v := range schedule.Conf.Notifications {
+	for _, v := range sc.Notifications {
 		fmt.Fprintln(&buf, v.Def)
 	}
 	fmt.Fprintf(&buf, "%s\n", r.FormValue("template"))
 	fmt.Fprintf(&buf, "%s\n", r.FormValue("alert"))
-	c, err := conf.New("Test Config", buf.String())
+	c, err := conf.NewNoInclude("Test Config", buf.String())
 	if err != nil {
 		return nil, err
 	}
@@ -334,6 +334,14 @@ bosunControllers.controller('ConfigCtrl', ['$scope', '$http', '$location', '$rou
             $scope.error = error || 'Error';
         });
     };
+    $scope.format = function () {
+        $http.get('/api/config/format?config_text=' + encodeURIComponent($scope.config_text)).success(function (data) {
+            $scope.config_text = data;
+            $scope.error = '';
+        }).error(function (error) {
+            $scope.error = error;
+        });
+    };
     $scope.set();
 }]);
 bosunControllers.controller('DashboardCtrl', ['$scope', '$http', '$location', function ($scope, $http, $location) {
@@ -1027,6 +1035,7 @@ bosunControllers.controller('ExprCtrl', ['$scope', '$http', '$location', '$route
     $scope.expr = current;
     $scope.running = current;
     $scope.tab = 'results';
+    $scope.simplify = true;
     $scope.animate();
     $http.get('/api/expr?q=' + encodeURIComponent(current) + '&date=' + encodeURIComponent($scope.date) + '&time=' + encodeURIComponent($scope.time)).success(function (data) {
         $scope.result = data.Results;
@@ -1049,6 +1058,27 @@ bosunControllers.controller('ExprCtrl', ['$scope', '$http', '$location', '$route
         $location.search('time', $scope.time || null);
         $route.reload();
     };
+    $scope.format = function () {
+        $http.get('/api/expr/format?width=' + editorWidth() + '&simplify=' + $scope.simplify + '&q=' + encodeURIComponent($scope.expr)).success(function (data) {
+            $scope.expr = data;
+            $scope.error = '';
+        }).error(function (error) {
+            $scope.error = error;
+        });
+    };
+    // editorWidth returns the number of characters that fit on a line of the
+    // expression editor.
+    function editorWidth() {
+        var ta = document.getElementById('expr');
+        var span = document.createElement('span');
+        span.style.font = window.getComputedStyle(ta).font;
+        span.textContent = 'xxxxxxxxxx';
+        document.body.appendChild(span);
+        var cw = span.offsetWidth / 10;
+        document.body.removeChild(span);
+        // Leave room for the editor's padding.
+        return Math.max(Math.floor(ta.clientWidth / cw) - 2, 0);
+    }
     function toChart(res) {
         var graph = [];
         angular.forEach(res, function (d, idx) {
@@ -1076,7 +1106,7 @@ bosunControllers.controller('ExprCtrl', ['$scope', '$http', '$location', '$route
         return graph;
     }
     $scope.keydown = function ($event) {
-        if ($event.keyCode == 13) {
+        if ($event.keyCode == 13 && $event.shiftKey) {
             $scope.set();
         }
     };
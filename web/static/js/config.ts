@@ -7,6 +7,7 @@ interface IConfigScope extends ng.IScope {
 	editor: any;
 	codemirrorLoaded: (editor: any) => void;
 	set: () => void;
+	format: () => void;
 	line: number;
 }
 
@@ -51,5 +52,15 @@ bosunControllers.controller('ConfigCtrl', ['$scope', '$http', '$location', '$rou
 				$scope.error = error || 'Error';
 			});
 	}
+	$scope.format = () => {
+		$http.get('/api/config/format?config_text=' + encodeURIComponent($scope.config_text))
+			.success((data: string) => {
+				$scope.config_text = data;
+				$scope.error = '';
+			})
+			.error((error) => {
+				$scope.error = error;
+			});
+	};
 	$scope.set();
 }]);
@@ -6,6 +6,8 @@ interface IExprScope extends ng.IScope {
 	queries: any;
 	result_type: string;
 	set: () => void;
+	format: () => void;
+	simplify: boolean;
 	tab: string;
 	graph: any;
 	svg_url: string;
@@ -34,6 +36,7 @@ bosunControllers.controller('ExprCtrl', ['$scope', '$http', '$location', '$route
 	$scope.expr = current;
 	$scope.running = current;
 	$scope.tab = 'results';
+	$scope.simplify = true;
 	$scope.animate();
 	$http.get('/api/expr?q=' +
 		encodeURIComponent(current) +
@@ -62,6 +65,31 @@ bosunControllers.controller('ExprCtrl', ['$scope', '$http', '$location', '$route
 		$location.search('time', $scope.time || null);
 		$route.reload();
 	};
+	$scope.format = () => {
+		$http.get('/api/expr/format?width=' + editorWidth() +
+			'&simplify=' + $scope.simplify +
+			'&q=' + encodeURIComponent($scope.expr))
+			.success((data: string) => {
+				$scope.expr = data;
+				$scope.error = '';
+			})
+			.error((error) => {
+				$scope.error = error;
+			});
+	};
+	// editorWidth returns the number of characters that fit on a line of the
+	// expression editor.
+	function editorWidth() {
+		var ta = document.getElementById('expr');
+		var span = document.createElement('span');
+		span.style.font = window.getComputedStyle(ta).font;
+		span.textContent = 'xxxxxxxxxx';
+		document.body.appendChild(span);
+		var cw = span.offsetWidth / 10;
+		document.body.removeChild(span);
+		// Leave room for the editor's padding.
+		return Math.max(Math.floor(ta.clientWidth / cw) - 2, 0);
+	}
 	function toChart(res: any) {
 		var graph: any = [];
 		angular.forEach(res, (d, idx) => {
@@ -89,7 +117,7 @@ bosunControllers.controller('ExprCtrl', ['$scope', '$http', '$location', '$route
 		return graph;
 	}
 	$scope.keydown = function($event: any) {
-		if ($event.keyCode == 13) {
+		if ($event.keyCode == 13 && $event.shiftKey) {
 			$scope.set();
 		}
 	}
@@ -3,6 +3,7 @@ package web
 import (
 	"bytes"
 	"compress/gzip"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
@@ -31,6 +32,8 @@ var (
 	templates *template.Template
 	router    = mux.NewRouter()
 	schedule  = sched.DefaultSched
+	// reloadConf reparses the configuration file and reloads it into schedule.
+	reloadConf func() error
 )
 
 const tsdbFormat = "2006/01/02-15:04"
@@ -40,7 +43,8 @@ func init() {
 	miniprofiler.StartHidden = true
 }
 
-func Listen(listenAddr, webDirectory string, tsdbHost *url.URL) error {
+func Listen(listenAddr, webDirectory string, tsdbHost *url.URL, reload func() error) error {
+	reloadConf = reload
 	var err error
 	templates, err = template.New("").ParseFiles(
 		webDirectory + "/templates/index.html",
@@ -52,9 +56,11 @@ func Listen(listenAddr, webDirectory string, tsdbHost *url.URL) error {
 	router.Handle("/api/action", JSON(Action))
 	router.Handle("/api/alerts", JSON(Alerts))
 	router.Handle("/api/config", miniprofiler.NewHandler(Config))
+	router.Handle("/api/config/format", miniprofiler.NewHandler(ConfigFormat))
 	router.Handle("/api/config_test", miniprofiler.NewHandler(ConfigTest))
 	router.Handle("/api/egraph/{bs}.svg", JSON(ExprGraph))
 	router.Handle("/api/expr", JSON(Expr))
+	router.Handle("/api/expr/format", JSON(ExprFormat))
 	router.Handle("/api/graph", JSON(Graph))
 	router.Handle("/api/health", JSON(HealthCheck))
 	router.Handle("/api/host", JSON(Host))
@@ -73,6 +79,7 @@ func Listen(listenAddr, webDirectory string, tsdbHost *url.URL) error {
 	router.Handle("/api/tagv/{tagk}/{metric}", JSON(TagValuesByMetricTagKey))
 	router.Handle("/api/templates", JSON(Templates))
 	router.Handle("/api/put", Relay(tsdbHost))
+	router.Handle("/api/reload", JSON(Reload))
 	router.Handle("/api/run", JSON(Run))
 	http.Handle("/", miniprofiler.NewHandler(Index))
 	http.Handle("/api/", router)
@@ -214,7 +221,7 @@ type Health struct {
 
 func HealthCheck(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
 	var h Health
-	h.RuleCheck = schedule.LastCheck.After(time.Now().Add(-schedule.Conf.CheckFrequency))
+	h.RuleCheck = schedule.LastCheck.After(time.Now().Add(-schedule.Config().CheckFrequency))
 	return h, nil
 }
 
@@ -385,18 +392,45 @@ func SilenceClear(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request)
 }
 
 func ConfigTest(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
-	_, err := conf.New("test", r.FormValue("config_text"))
+	_, err := conf.NewNoInclude("test", r.FormValue("config_text"))
 	if err != nil {
 		fmt.Fprint(w, err.Error())
 	}
 }
 
 func Config(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
-	fmt.Fprint(w, schedule.Conf.RawText)
+	fmt.Fprint(w, schedule.Config().RawText)
+}
+
+func ConfigFormat(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) {
+	text, err := conf.Format("test", r.FormValue("config_text"))
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	fmt.Fprint(w, text)
 }
 
 func Templates(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	return schedule.Conf.AlertTemplateStrings()
+	return schedule.Config().AlertTemplateStrings()
+}
+
+// Reload reloads the configuration file. It must be POSTed with the token in
+// the file named by the reloadTokenFile config key.
+func Reload(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	if r.Method != "POST" {
+		http.Error(w, "reload must be POSTed", http.StatusMethodNotAllowed)
+		return nil, nil
+	}
+	token := schedule.Config().ReloadToken
+	if token == "" || subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(token)) != 1 {
+		http.Error(w, "reload not authorized", http.StatusForbidden)
+		return nil, nil
+	}
+	if err := reloadConf(); err != nil {
+		return nil, err
+	}
+	return schedule.Config().Name, nil
 }
 
 func APIRedirect(w http.ResponseWriter, req *http.Request) {
@@ -404,7 +438,7 @@ func APIRedirect(w http.ResponseWriter, req *http.Request) {
 }
 
 func Run(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
-	return schedule.Check(t, time.Now())
+	return schedule.CheckAll(t, time.Now())
 }
 
 func Host(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {